@@ -0,0 +1,105 @@
+package talky
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyPrefix starts every api key, so they can be told apart from the jwt access tokens.
+	APIKeyPrefix = "tk_"
+
+	// apiKeyIDLength is the length of the public part of the key which is used to look it up.
+	apiKeyIDLength = 8
+)
+
+// The scopes an api key can be given. Users who login with their password are not limited by scopes.
+const (
+	ScopeJoinRoom     = "rooms:join"
+	ScopeReadPresence = "presence:read"
+
+	// ScopeRecord marks the bots which record the calls, they are kept out of the end-to-end
+	// encrypted rooms.
+	ScopeRecord = "rooms:record"
+)
+
+var validScopes = map[string]bool{
+	ScopeJoinRoom:     true,
+	ScopeReadPresence: true,
+	ScopeRecord:       true,
+}
+
+// IsValidScope reports if the scope is one of the known scopes.
+func IsValidScope(scope string) bool {
+	return validScopes[scope]
+}
+
+// APIKey is a long lived credential of a bot account. Like the user tokens only its hash is stored,
+// the key itself is shown once when it is created.
+type APIKey struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"index"`
+	Name       string `gorm:"type:varchar(64)"`
+	Prefix     string `gorm:"type:varchar(16);unique_index"` // Prefix is the public part of the key used to find it.
+	KeyHash    string `gorm:"type:varchar(64)"`
+	ScopeList  string // ScopeList holds the comma separated scopes of the key.
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+// NewAPIKey generates a new key for the user with the given scopes. It returns the key to be stored
+// and the plain text key which should be handed to the owner.
+func NewAPIKey(userID uint, name string, scopes []string) (*APIKey, string, error) {
+	id, err := RandomToken(apiKeyIDLength)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix := APIKeyPrefix + id[:apiKeyIDLength]
+	plain := prefix + "_" + secret
+
+	key := &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   HashToken(plain),
+		ScopeList: strings.Join(scopes, ","),
+	}
+
+	return key, plain, nil
+}
+
+// APIKeyPrefixOf returns the lookup prefix of a plain text key.
+func APIKeyPrefixOf(plain string) (string, bool) {
+	if !strings.HasPrefix(plain, APIKeyPrefix) || len(plain) < len(APIKeyPrefix)+apiKeyIDLength+1 {
+		return "", false
+	}
+
+	return plain[:len(APIKeyPrefix)+apiKeyIDLength], true
+}
+
+// Matches reports if the plain text key is this key.
+func (k *APIKey) Matches(plain string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(plain)), []byte(k.KeyHash)) == 1
+}
+
+// Scopes returns the scopes the key was given.
+func (k *APIKey) Scopes() []string {
+	if k.ScopeList == "" {
+		return []string{}
+	}
+
+	return strings.Split(k.ScopeList, ",")
+}
+
+// IsRevoked reports if the key was revoked.
+func (k *APIKey) IsRevoked() bool {
+	return k.RevokedAt != nil
+}
@@ -0,0 +1,68 @@
+package talky
+
+import "time"
+
+// AuditAction is the kind of a security relevant event.
+type AuditAction string
+
+const (
+	AuditLoginSuccess      AuditAction = "login.success"
+	AuditLoginFailure      AuditAction = "login.failure"
+	AuditRegister          AuditAction = "user.register"
+	AuditAPIKeyCreate      AuditAction = "api_key.create"
+	AuditAPIKeyRevoke      AuditAction = "api_key.revoke"
+	AuditIdentityKeySet    AuditAction = "identity_key.set"
+	AuditIdentityKeyDelete AuditAction = "identity_key.delete"
+	AuditRoomJoin          AuditAction = "room.join"
+	AuditRoomLeave         AuditAction = "room.leave"
+	AuditHangup            AuditAction = "room.hangup"
+	AuditRoomClose         AuditAction = "moderation.room_close"
+	AuditKick              AuditAction = "moderation.kick"
+	AuditScreenShareStop   AuditAction = "moderation.screen_share_stop"
+	AuditMute              AuditAction = "moderation.mute"
+	AuditMuteAll           AuditAction = "moderation.mute_all"
+	AuditDisconnect        AuditAction = "moderation.disconnect"
+	AuditUserDisable       AuditAction = "moderation.user_disable"
+	AuditUserEnable        AuditAction = "moderation.user_enable"
+	AuditRoleChange        AuditAction = "moderation.role_change"
+	AuditAccountUnlock     AuditAction = "moderation.account_unlock"
+)
+
+// AuditEvent records who did what to whom. ActorID is zero when the actor is not known, like for
+// a failed login of an unknown username. The user id columns are bigints, as the ids of the guests
+// don't fit in 32 bits.
+type AuditEvent struct {
+	ID           uint        `gorm:"primary_key" json:"id"`
+	Action       AuditAction `gorm:"type:varchar(64);index" json:"action"`
+	ActorID      uint        `gorm:"type:bigint;index" json:"actor_id,omitempty"`
+	ActorName    string      `gorm:"type:varchar(64)" json:"actor_name,omitempty"`
+	TargetUserID uint        `gorm:"type:bigint;index" json:"target_user_id,omitempty"`
+	RoomID       string      `gorm:"type:varchar(64);index" json:"room_id,omitempty"`
+	IP           string      `gorm:"type:varchar(64)" json:"ip,omitempty"`
+	Detail       string      `json:"detail,omitempty"`
+	CreatedAt    time.Time   `gorm:"index" json:"created_at"`
+}
+
+// The sizes of the free text columns of the audit events.
+const (
+	maxAuditNameLength   = 64
+	maxAuditDetailLength = 255
+)
+
+// Truncate cuts the free text fields to the size of their columns. The actor name of a failed login
+// is whatever username was sent, an event which doesn't fit would not be stored at all.
+func (e *AuditEvent) Truncate() {
+	e.ActorName = truncate(e.ActorName, maxAuditNameLength)
+	e.Detail = truncate(e.Detail, maxAuditDetailLength)
+}
+
+// Auditor receives the audit events. Record must not block, the events are usually persisted
+// in the background.
+type Auditor interface {
+	Record(event *AuditEvent)
+}
+
+// NopAuditor drops the events, it is used when no auditor is configured.
+type NopAuditor struct{}
+
+func (NopAuditor) Record(*AuditEvent) {}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// queueSize is how many events can wait to be written before new ones are dropped.
+const queueSize = 1024
+
+// Logger is a talky.Auditor which persists the events in the background, so recording an event
+// never slows down a login or the hub. The events are written to the repository and, when a sink
+// is given, as JSON lines to the sink as well.
+type Logger struct {
+	repo store.AuditRepository
+	sink io.Writer
+
+	events chan *talky.AuditEvent
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewLogger creates the logger and starts its writer. Either the repository or the sink can be nil.
+func NewLogger(repo store.AuditRepository, sink io.Writer) *Logger {
+	l := &Logger{
+		repo:   repo,
+		sink:   sink,
+		events: make(chan *talky.AuditEvent, queueSize),
+		done:   make(chan struct{}),
+	}
+
+	go l.run()
+	return l
+}
+
+// Record queues the event. When the queue is full the event is logged and dropped rather than
+// blocking the caller.
+func (l *Logger) Record(event *talky.AuditEvent) {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	event.Truncate()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return
+	}
+
+	select {
+	case l.events <- event:
+	default:
+		log.Printf("Audit queue is full, dropping %s event of user %d", event.Action, event.ActorID)
+	}
+}
+
+// Close stops accepting events and waits until the queued ones are written.
+func (l *Logger) Close() {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.mu.Unlock()
+
+	<-l.done
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+
+	var enc *json.Encoder
+	if l.sink != nil {
+		enc = json.NewEncoder(l.sink)
+	}
+
+	for event := range l.events {
+		if l.repo != nil {
+			if err := l.repo.CreateEvent(event); err != nil {
+				log.Printf("Error storing %s audit event: %v", event.Action, err)
+			}
+		}
+
+		if enc != nil {
+			if err := enc.Encode(event); err != nil {
+				log.Printf("Error writing %s audit event: %v", event.Action, err)
+			}
+		}
+	}
+}
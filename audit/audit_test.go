@@ -0,0 +1,44 @@
+package audit
+
+import (
+	"errors"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// fakeRepo keeps the stored events, like a strict database it refuses the values which don't fit
+// in their columns.
+type fakeRepo struct {
+	store.AuditRepository
+	events []*talky.AuditEvent
+}
+
+func (f *fakeRepo) CreateEvent(event *talky.AuditEvent) error {
+	if utf8.RuneCountInString(event.ActorName) > 64 || utf8.RuneCountInString(event.Detail) > 255 {
+		return errors.New("data too long for column")
+	}
+
+	f.events = append(f.events, event)
+	return nil
+}
+
+func TestRecordTruncatesLongValues(t *testing.T) {
+	repo := &fakeRepo{}
+	l := NewLogger(repo, nil)
+
+	l.Record(&talky.AuditEvent{Action: talky.AuditLoginFailure, ActorName: strings.Repeat("x", 1000), Detail: strings.Repeat("ü", 1000)})
+	l.Close()
+
+	if len(repo.events) != 1 {
+		t.Fatalf("%d events were stored, want the failed login", len(repo.events))
+	}
+
+	event := repo.events[0]
+	if event.ActorName != strings.Repeat("x", 64) || event.Detail != strings.Repeat("ü", 255) {
+		t.Errorf("stored actor name of %d and detail of %d characters, want 64 and 255",
+			utf8.RuneCountInString(event.ActorName), utf8.RuneCountInString(event.Detail))
+	}
+}
@@ -0,0 +1,23 @@
+package blob
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// Storage stores binary objects, like the user avatars, under a slash separated key.
+type Storage interface {
+	// Put stores the content read from r under the key, replacing the existing blob if any.
+	Put(key string, r io.Reader) error
+
+	// Get opens the blob stored under the key. It returns ErrNotFound if there is no such blob.
+	Get(key string) (io.ReadCloser, error)
+
+	// Delete removes all the blobs whose key starts with the prefix.
+	Delete(prefix string) error
+}
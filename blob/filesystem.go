@@ -0,0 +1,88 @@
+package blob
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type fileSystemStorage struct {
+	dir string
+}
+
+// NewFileSystemStorage creates a Storage which keeps the blobs as files under dir. The directory
+// is created if it does not exist.
+func NewFileSystemStorage(dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &fileSystemStorage{dir: dir}, nil
+}
+
+func (fs *fileSystemStorage) Put(key string, r io.Reader) error {
+	name, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first and move it in place, so readers never see a half written blob.
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+func (fs *fileSystemStorage) Get(key string) (io.ReadCloser, error) {
+	name, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+func (fs *fileSystemStorage) Delete(prefix string) error {
+	name, err := fs.path(prefix)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(name)
+}
+
+// path maps the key to a file inside the storage directory, rejecting the keys which would
+// escape it.
+func (fs *fileSystemStorage) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "..") {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(fs.dir, filepath.FromSlash(cleaned)), nil
+}
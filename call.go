@@ -0,0 +1,114 @@
+package talky
+
+import (
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// maxParticipantNameLength is the size of the username column of the participants.
+const maxParticipantNameLength = 64
+
+// Call is the record of a call which took place in a room, from the first member joining until
+// the room became empty again. A user shows up once in the participants for every time they joined.
+type Call struct {
+	ID           uint              `gorm:"primary_key" json:"id"`
+	RoomID       string            `gorm:"type:varchar(64);index" json:"room_id"`
+	RoomType     RoomType          `gorm:"type:varchar(16)" json:"room_type"`
+	StartedAt    time.Time         `gorm:"index" json:"started_at"`
+	EndedAt      time.Time         `json:"ended_at"`
+	Duration     int64             `json:"duration"` // Duration of the call in seconds.
+	Participants []CallParticipant `json:"participants"`
+	Quality      []CallQuality     `json:"-"`
+	PoorQuality  bool              `gorm:"index" json:"poor_quality"` // PoorQuality is set when any participant had a poor call.
+
+	qualities map[uint]*CallQuality // qualities aggregates the stats reports per user while the call goes on.
+}
+
+// CallParticipant is a single stay of a user in a call. The user id column is a bigint, as the ids
+// of the guests don't fit in 32 bits.
+type CallParticipant struct {
+	ID       uint      `gorm:"primary_key" json:"-"`
+	CallID   uint      `gorm:"index" json:"-"`
+	UserID   uint      `gorm:"type:bigint;index" json:"user_id"`
+	Username string    `gorm:"type:varchar(64)" json:"username"`
+	Guest    bool      `json:"guest"`
+	JoinedAt time.Time `json:"joined_at"`
+	LeftAt   time.Time `json:"left_at"`
+	Duration int64     `json:"duration"` // Duration of the stay in seconds.
+}
+
+// CallRecorder stores the calls once they have ended. The hub calls it in the background, so it
+// may take its time.
+type CallRecorder interface {
+	CreateCall(call *Call) error
+}
+
+func newCall(room *Room) *Call {
+	return &Call{
+		RoomID:    room.ID,
+		RoomType:  room.RoomType,
+		StartedAt: time.Now(),
+		qualities: make(map[uint]*CallQuality),
+	}
+}
+
+// join adds a new stay of the user to the call.
+func (c *Call) join(user *User) {
+	c.Participants = append(c.Participants, CallParticipant{
+		UserID:   user.ID,
+		Username: truncate(user.Username, maxParticipantNameLength),
+		Guest:    user.Guest,
+		JoinedAt: time.Now(),
+	})
+}
+
+// leave closes the open stay of the user.
+func (c *Call) leave(userID uint) {
+	for i := range c.Participants {
+		p := &c.Participants[i]
+		if p.UserID == userID && p.LeftAt.IsZero() {
+			p.LeftAt = time.Now()
+			p.Duration = int64(p.LeftAt.Sub(p.JoinedAt).Seconds())
+		}
+	}
+}
+
+// addStats adds the stats report of the user to their quality aggregate.
+func (c *Call) addStats(userID uint, report StatsReport) {
+	q, ok := c.qualities[userID]
+	if !ok {
+		q = &CallQuality{UserID: userID}
+		c.qualities[userID] = q
+	}
+
+	q.add(report)
+}
+
+// end closes the stays of the remaining participants and the call itself.
+func (c *Call) end() {
+	for _, p := range c.Participants {
+		c.leave(p.UserID)
+	}
+
+	for _, q := range c.qualities {
+		c.Quality = append(c.Quality, *q)
+		if q.IsPoor() {
+			c.PoorQuality = true
+		}
+	}
+
+	sort.Slice(c.Quality, func(i, j int) bool { return c.Quality[i].UserID < c.Quality[j].UserID })
+
+	c.EndedAt = time.Now()
+	c.Duration = int64(c.EndedAt.Sub(c.StartedAt).Seconds())
+}
+
+// truncate cuts the string to at most n characters, so it fits in its column.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,29 @@
+package talky
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCallJoinTruncatesUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"alice", "alice"},
+		{strings.Repeat("a", maxParticipantNameLength), strings.Repeat("a", maxParticipantNameLength)},
+		{strings.Repeat("a", 300), strings.Repeat("a", maxParticipantNameLength)},
+		{strings.Repeat("é", 100), strings.Repeat("é", maxParticipantNameLength)},
+	}
+
+	for _, tt := range tests {
+		call := newCall(NewRoom(AudioRoom, "room"))
+		call.join(&User{ID: 1, Username: tt.username})
+
+		got := call.Participants[0].Username
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("participant %.10s... got username %.10s... of %d characters, want %d", tt.username, got, utf8.RuneCountInString(got), utf8.RuneCountInString(tt.want))
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package talky
 
 import (
-	"bytes"
 	"github.com/gorilla/websocket"
+	"github.com/iamsayantan/talky/metrics"
 	"log"
 	"time"
 )
@@ -19,6 +19,10 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 1024 * 100
+
+	// Maximum number of messages waiting to be written to the peer. A peer which falls further
+	// behind with only critical messages waiting is disconnected.
+	maxQueuedMessages = 256
 )
 
 var (
@@ -38,24 +42,82 @@ type Client struct {
 
 	conn *websocket.Conn
 
-	// Buffered channel for outbound messages.
-	sendCh chan []byte
+	// codec is the wire format negotiated with the peer.
+	codec Codec
+
+	// queue holds the outbound messages until the write pump gets to them.
+	queue *sendQueue
 }
 
-// NewClient creates a new client.
+// NewClient creates a new client and registers it with the hub.
 func NewClient(hub *Hub, user *User, conn *websocket.Conn) *Client {
 	client := &Client{
-		hub:    hub,
-		user:   user,
-		conn:   conn,
-		sendCh: make(chan []byte),
+		hub:   hub,
+		user:  user,
+		conn:  conn,
+		codec: codecFor(conn.Subprotocol()),
+		queue: newSendQueue(maxQueuedMessages),
 	}
 
+	// the hub has to know the client before it gets the first message from it, or the news of its
+	// disconnection.
+	hub.AddClient(client)
+
 	go client.readPump()
 	go client.writePump()
 	return client
 }
 
+// send queues the message to be written to the peer, it never blocks the hub.
+// When the peer can't keep up the oldest droppable message is dropped to make room, and if none of
+// the waiting messages can be dropped the peer is disconnected. See sendPolicies.
+func (c *Client) send(message *ResponseMessage) {
+	dropped, err := c.queue.push(message)
+	if dropped != "" {
+		metrics.SendDropped.WithLabelValues(dropped).Inc()
+	}
+
+	if err != errQueueFull {
+		return
+	}
+
+	log.Printf("Send queue of user %d is full, disconnecting the slow client", c.user.ID)
+	metrics.SlowConsumerDisconnects.Inc()
+	c.queue.abort()
+
+	// the write pump may be stuck writing to the slow connection, closing it gets both pumps out.
+	_ = c.conn.Close()
+}
+
+// reply acknowledges the message of the client, or tells the client why it failed when err is not
+// nil. msg is nil when the message could not be read at all.
+func (c *Client) reply(msg *Message, err error) {
+	var requestID, msgType string
+	if msg != nil {
+		requestID, msgType = msg.ID, msg.Type
+	}
+
+	if err == nil {
+		ack := newResponse(Ack, AckMessage{RequestID: requestID})
+		ack.lossy = lossyRequests[msgType]
+		c.send(ack)
+		return
+	}
+
+	metrics.HubErrors.WithLabelValues(c.hub.messageTypeLabel(msgType)).Inc()
+	c.send(newResponse(Error, ErrorMessage{
+		Code:      errorCode(err),
+		Message:   err.Error(),
+		RequestID: requestID,
+	}))
+}
+
+// close makes the write pump close the connection once the queued messages are written, the read
+// pump then removes the client from the hub.
+func (c *Client) close() {
+	c.queue.close()
+}
+
 // readPump pumps messages from the websocket connection to the hub.
 //
 // The application runs readPump in a per-connection goroutine. The application
@@ -86,10 +148,16 @@ func (c *Client) readPump() {
 			return
 		}
 
-		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		message, err = c.codec.Decode(message)
+		if err != nil {
+			c.reply(nil, err)
+			continue
+		}
+
 		broadcast := &BroadcastMessage{
 			User:    c.user,
 			Payload: message,
+			client:  c,
 		}
 		c.hub.broadcastCh <- broadcast
 	}
@@ -109,25 +177,29 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.sendCh:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-
-			if !ok {
-				// if we fail to read message from the send channel of the client, that means the hub
-				// closed the connection. so we just inform the client that the connection has been closed.
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.queue.ready:
+			messages, closed := c.queue.pop()
+			for _, message := range messages {
+				data, err := c.codec.Encode(message)
+				if err != nil {
+					log.Printf("Error encoding %s message: %v", message.Type, err)
+					continue
+				}
+
+				_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := c.conn.WriteMessage(c.codec.FrameType(), data); err != nil {
+					return
+				}
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if closed {
+				// the queue is closed when the hub disconnects the client. so we just inform the client
+				// that the connection has been closed.
+				_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			_, _ = w.Write(message)
-			if err := w.Close(); err != nil {
-				return
-			}
 		case <-ticker.C:
 			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
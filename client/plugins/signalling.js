@@ -1,3 +1,5 @@
+const PROTOCOL_VERSION = 1;
+
 class Signalling {
   constructor(websocketURL) {
     if (!!Signalling.instance) {
@@ -8,19 +10,23 @@ class Signalling {
     this._websocket = null;
     this._onSignallingMessage = null;
     this._hearbeatId = null;
+    this._lastRequestId = 0;
 
     Signalling.instance = this
     return this
   }
 
-  open(authToken) {
+  // open connects with a single use ticket from the /ws/ticket endpoint, the access token must not
+  // end up in the url.
+  open(ticket) {
     if (this._websocket) {
       console.error('[Signalling] Websocket connection already established.');
       return;
     }
 
     return new Promise((resolve, reject) => {
-      this._websocket = new WebSocket(`${this._websocketUrl}?auth_token=${authToken}`)
+      const websocket = new WebSocket(`${this._websocketUrl}?ticket=${encodeURIComponent(ticket)}`)
+      this._websocket = websocket
 
       this._websocket.onopen = () => {
         resolve();
@@ -35,8 +41,11 @@ class Signalling {
 
       this._websocket.onclose = (evt) => {
         console.log('[Signalling] Websocket connection closed: ', evt);
-        clearInterval(this._hearbeatId);
-        this._websocket = null
+        // a closed connection which was already replaced must not clear the new one.
+        if (this._websocket === websocket) {
+          clearInterval(this._hearbeatId);
+          this._websocket = null
+        }
       }
 
       this._websocket.onmessage = (evt) => {
@@ -47,8 +56,22 @@ class Signalling {
     });
   }
 
+  close() {
+    if (this._websocket) {
+      clearInterval(this._hearbeatId);
+      this._websocket.close();
+      this._websocket = null;
+    }
+  }
+
+  /**
+   * Sends the message and returns its id, the server refers to it in the ACK or the error it sends back.
+   */
   send(type, payload) {
+    this._lastRequestId += 1;
     const wsMessage = {
+      id: String(this._lastRequestId),
+      v: PROTOCOL_VERSION,
       type,
       payload
     };
@@ -56,6 +79,8 @@ class Signalling {
     if (this._websocket && this._websocket.readyState === WebSocket.OPEN) {
       this._websocket.send(JSON.stringify(wsMessage))
     }
+
+    return wsMessage.id;
   }
 
   heartbeat() {
@@ -1,14 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/audit"
+	"github.com/iamsayantan/talky/blob"
+	"github.com/iamsayantan/talky/mail"
+	"github.com/iamsayantan/talky/ratelimit"
 	"github.com/iamsayantan/talky/server"
+	"github.com/iamsayantan/talky/store"
 	"github.com/iamsayantan/talky/store/mysql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
@@ -24,6 +37,30 @@ var (
 	defaultDBName     = getFromEnv("DATABASE_NAME", "talky")
 
 	defaultServerPort = getFromEnv("PORT", "9050")
+	defaultDrain      = getFromEnv("SHUTDOWN_DRAIN", "30s")
+	defaultAdmins     = getFromEnv("ADMIN_USERNAMES", "")
+	defaultAppURL     = getFromEnv("APP_URL", "http://localhost:3000")
+	defaultOrigins    = getFromEnv("ALLOWED_ORIGINS", "")
+	defaultProxies    = getFromEnv("TRUSTED_PROXIES", "")
+
+	defaultSMTPHost     = getFromEnv("SMTP_HOST", "")
+	defaultSMTPPort     = getFromEnv("SMTP_PORT", "25")
+	defaultSMTPUsername = getFromEnv("SMTP_USERNAME", "")
+	defaultSMTPPassword = getFromEnv("SMTP_PASSWORD", "")
+	defaultMailFrom     = getFromEnv("MAIL_FROM", "talky <no-reply@localhost>")
+
+	defaultAvatarDir = getFromEnv("AVATAR_DIR", "data/avatars")
+	defaultAuditFile = getFromEnv("AUDIT_FILE", "")
+
+	defaultWsRateLimit      = getFromEnv("WS_RATE_LIMIT", "50:300")
+	defaultWsTypeLimits     = getFromEnv("WS_TYPE_LIMITS", "CREATE_OR_JOIN=0.5:5,HANGUP=0.5:5,STATS=2:40,CHAT=1:10,HAND_RAISE=0.5:5,MEDIA_STATE=2:20,MUTE_ALL=0.2:3,AUDIO_LEVEL=10:20")
+	defaultWsViolationLimit = getFromEnv("WS_VIOLATION_LIMIT", "0.5:30")
+	defaultAuthRateLimit    = getFromEnv("AUTH_RATE_LIMIT", "0.2:10")
+
+	defaultStripPrivateCandidates = getFromEnv("STRIP_PRIVATE_CANDIDATES", "false")
+	defaultAudioCodecs            = getFromEnv("AUDIO_CODECS", "")
+	defaultVideoCodecs            = getFromEnv("VIDEO_CODECS", "")
+	defaultScreenShares           = getFromEnv("MAX_SCREEN_SHARES", "1")
 )
 
 func main() {
@@ -34,18 +71,73 @@ func main() {
 	dbUsername := flag.String("db.username", defaultDBUsername, "Database username")
 	dbPassword := flag.String("db.password", defaultDBPassword, "Database password")
 	serverPort := flag.String("server.port", defaultServerPort, "Server port where the server runs")
+	drain := flag.String("server.drain", defaultDrain, "How long the clients are given to reconnect elsewhere on shutdown")
+	admins := flag.String("admin.usernames", defaultAdmins, "Comma separated list of usernames who are given the admin role on startup")
+	appURL := flag.String("app.url", defaultAppURL, "Base url of the web client, used for the links in emails")
+	allowedOrigins := flag.String("server.allowed_origins", defaultOrigins, "Comma separated origins allowed to call the api and open websocket connections, the origin of the app url when empty")
+	trustedProxies := flag.String("server.trusted_proxies", defaultProxies, "Comma separated addresses or CIDR ranges of the reverse proxies whose X-Forwarded-For headers are trusted, none when empty")
+	smtpHost := flag.String("smtp.host", defaultSMTPHost, "SMTP server host, emails are only logged when empty")
+	smtpPort := flag.String("smtp.port", defaultSMTPPort, "SMTP server port")
+	smtpUsername := flag.String("smtp.username", defaultSMTPUsername, "SMTP username")
+	smtpPassword := flag.String("smtp.password", defaultSMTPPassword, "SMTP password")
+	mailFrom := flag.String("mail.from", defaultMailFrom, "Sender address of the emails")
+	avatarDir := flag.String("avatar.dir", defaultAvatarDir, "Directory where the uploaded avatars are stored")
+	auditFile := flag.String("audit.file", defaultAuditFile, "File where the audit events are also appended as JSON lines, disabled when empty")
+	wsRateLimit := flag.String("ws.rate_limit", defaultWsRateLimit, "Websocket messages per second and burst allowed for every user, as rate:burst")
+	wsTypeLimits := flag.String("ws.type_limits", defaultWsTypeLimits, "Comma separated TYPE=rate:burst limits for single websocket message types")
+	wsViolationLimit := flag.String("ws.violation_limit", defaultWsViolationLimit, "How often a user may go over the websocket limits before being disconnected, as rate:burst")
+	authRateLimit := flag.String("auth.rate_limit", defaultAuthRateLimit, "Registrations, logins and password reset requests per second and burst allowed for every IP address, as rate:burst")
+	stripPrivateCandidates := flag.String("ice.strip_private", defaultStripPrivateCandidates, "Drop the host ICE candidates and hide the private addresses, so the members don't learn each others local addresses")
+	audioCodecs := flag.String("sdp.audio_codecs", defaultAudioCodecs, "Comma separated audio codecs allowed in the calls, like opus,red. Every codec is allowed when empty")
+	videoCodecs := flag.String("sdp.video_codecs", defaultVideoCodecs, "Comma separated video codecs allowed in the calls, like VP8,rtx. Every codec is allowed when empty")
+	screenShares := flag.String("room.max_screen_shares", defaultScreenShares, "How many members of an audio video room may share their screen at the same time, 0 disables screen sharing")
 
 	flag.Parse()
 
+	drainPeriod, err := time.ParseDuration(*drain)
+	if err != nil {
+		log.Fatalf("Invalid drain period %s: %v", *drain, err)
+	}
+
+	rateLimits, err := parseRateLimits(*wsRateLimit, *wsTypeLimits, *wsViolationLimit)
+	if err != nil {
+		log.Fatalf("Invalid websocket rate limits: %v", err)
+	}
+
+	authLimit, err := ratelimit.ParseLimit(*authRateLimit)
+	if err != nil {
+		log.Fatalf("Invalid auth rate limit: %v", err)
+	}
+
+	stripPrivate, err := strconv.ParseBool(*stripPrivateCandidates)
+	if err != nil {
+		log.Fatalf("Invalid ice.strip_private %s: %v", *stripPrivateCandidates, err)
+	}
+
+	maxScreenShares, err := strconv.Atoi(*screenShares)
+	if err != nil || maxScreenShares < 0 {
+		log.Fatalf("Invalid room.max_screen_shares %s", *screenShares)
+	}
+
+	proxies, err := server.ParseTrustedProxies(splitList(*trustedProxies))
+	if err != nil {
+		log.Fatalf("Invalid server.trusted_proxies: %v", err)
+	}
+
+	origins := splitList(*allowedOrigins)
+	if len(origins) == 0 {
+		origins, err = appOrigin(*appURL)
+		if err != nil {
+			log.Fatalf("Invalid app url %s: %v", *appURL, err)
+		}
+	}
+
 	// connect to the database
 	// format: "user:password@tcp(127.0.0.1:3306)/dbname?charset=utf8&parseTime=True&loc=Local"
 	dbCred := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8&parseTime=True&loc=Local", *dbUsername, *dbPassword, *dbHost, *dbPort, *dbName)
 	log.Printf("Database Credential: %s", dbCred)
 
-	var (
-		db  *gorm.DB
-		err error
-	)
+	var db *gorm.DB
 
 	if *dbType == "postgres" {
 		db, err = gorm.Open("postgres", fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s", *dbHost, *dbPort, *dbUsername, *dbName, *dbPassword))
@@ -58,13 +150,195 @@ func main() {
 	}
 
 	defer db.Close()
-	db.AutoMigrate(talky.User{})
+	db.AutoMigrate(talky.User{}, talky.UserToken{}, talky.APIKey{}, talky.AuditEvent{}, talky.Call{}, talky.CallParticipant{}, talky.CallQuality{}, talky.IdentityKey{})
+
+	var mailer mail.Mailer
+	if *smtpHost != "" {
+		port, err := strconv.Atoi(*smtpPort)
+		if err != nil {
+			log.Fatalf("Invalid smtp port %s: %v", *smtpPort, err)
+		}
+
+		mailer, err = mail.NewSMTPMailer(*smtpHost, port, *smtpUsername, *smtpPassword, *mailFrom)
+		if err != nil {
+			log.Fatalf("Error creating mailer: %v", err)
+		}
+	} else {
+		log.Printf("SMTP host is not configured, emails will only be logged")
+		mailer = mail.NewLogMailer()
+	}
+
+	avatarStorage, err := blob.NewFileSystemStorage(*avatarDir)
+	if err != nil {
+		log.Fatalf("Error creating avatar storage: %v", err)
+	}
+
+	var auditSink io.Writer
+	if *auditFile != "" {
+		f, err := os.OpenFile(*auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Error opening audit file: %v", err)
+		}
+
+		defer f.Close()
+		auditSink = f
+	}
+
+	auditRepo := mysql.NewAuditRepository(db)
+	auditLogger := audit.NewLogger(auditRepo, auditSink)
+	defer auditLogger.Close()
 
 	userRepo := mysql.NewUserRepository(db)
-	srv := server.NewServer(userRepo)
+	tokenRepo := mysql.NewTokenRepository(db)
+	apiKeyRepo := mysql.NewAPIKeyRepository(db)
+	promoteAdmins(userRepo, splitList(*admins))
+
+	srv := server.NewServer(server.Config{
+		UserRepo:        userRepo,
+		TokenRepo:       tokenRepo,
+		APIKeyRepo:      apiKeyRepo,
+		AuditRepo:       auditRepo,
+		CallRepo:        mysql.NewCallRepository(db),
+		IdentityKeyRepo: mysql.NewIdentityKeyRepository(db),
+		Auditor:         auditLogger,
+		Mailer:          mailer,
+		AppURL:          *appURL,
+		AllowedOrigins:  origins,
+		TrustedProxies:  proxies,
+		AvatarStorage:   avatarStorage,
+		DB:              db.DB(),
+		RateLimits:      rateLimits,
+		AuthRateLimit:   authLimit,
+		SignallingPolicy: talky.SignallingPolicy{
+			StripPrivateCandidates: stripPrivate,
+			Media:                  mediaPolicies(splitList(*audioCodecs), splitList(*videoCodecs), maxScreenShares),
+		},
+	})
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%s", *serverPort),
+		Handler: srv,
+	}
+
+	go func() {
+		log.Printf("Server starting on port %s", *serverPort)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error running the server: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+
+	log.Printf("Shutting down, draining the clients for up to %s", drainPeriod)
+	ctx, cancel := context.WithTimeout(context.Background(), drainPeriod)
+	defer cancel()
+	srv.Drain(ctx)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down the server: %v", err)
+	}
+
+	// the websocket connections are hijacked, so the http server doesn't close them for us.
+	srv.Close()
+	log.Printf("Server stopped")
+}
+
+// promoteAdmins gives the admin role to the users, so there is a way to create the first admin
+// who can then manage the roles through the admin api.
+func promoteAdmins(userRepo store.UserRepository, usernames []string) {
+	for _, username := range usernames {
+		user, err := userRepo.FindByUsername(username)
+		if err != nil {
+			log.Printf("Can not make %s an admin: %v", username, err)
+			continue
+		}
+
+		if user.Role == talky.RoleAdmin {
+			continue
+		}
+
+		if err := userRepo.UpdateRole(user.ID, talky.RoleAdmin); err != nil {
+			log.Printf("Can not make %s an admin: %v", username, err)
+			continue
+		}
+
+		log.Printf("Gave the admin role to %s", username)
+	}
+}
+
+// parseRateLimits builds the websocket rate limits from the flags.
+func parseRateLimits(connection, types, violations string) (talky.RateLimits, error) {
+	var limits talky.RateLimits
+	var err error
+
+	if limits.Connection, err = ratelimit.ParseLimit(connection); err != nil {
+		return limits, err
+	}
+
+	if limits.Types, err = ratelimit.ParseLimits(types); err != nil {
+		return limits, err
+	}
+
+	if limits.Violations, err = ratelimit.ParseLimit(violations); err != nil {
+		return limits, err
+	}
+
+	return limits, nil
+}
+
+// appOrigin returns the origin of the web client, which is the only one allowed unless configured
+// otherwise.
+func appOrigin(appURL string) ([]string, error) {
+	u, err := url.Parse(appURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("missing scheme or host")
+	}
+
+	return []string{u.Scheme + "://" + u.Host}, nil
+}
+
+// mediaPolicies adds the allowed codecs and the screen share limit to the default media policies of
+// the room types. The room types which don't allow screen sharing by default keep not allowing it.
+func mediaPolicies(audioCodecs, videoCodecs []string, screenShares int) map[talky.RoomType]talky.MediaPolicy {
+	codecs := make(map[string][]string)
+	if len(audioCodecs) > 0 {
+		codecs["audio"] = audioCodecs
+	}
+
+	if len(videoCodecs) > 0 {
+		codecs["video"] = videoCodecs
+	}
+
+	policies := make(map[talky.RoomType]talky.MediaPolicy, len(talky.DefaultMediaPolicies))
+	for roomType, policy := range talky.DefaultMediaPolicies {
+		policy.Codecs = codecs
+		if policy.ScreenShares > 0 {
+			policy.ScreenShares = screenShares
+		}
+		policies[roomType] = policy
+	}
+
+	return policies
+}
+
+// splitList splits a comma separated flag value, ignoring the empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
 
-	log.Printf("Server starting on port %s", *serverPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", *serverPort), srv))
+	return items
 }
 
 func getFromEnv(key, defaultValue string) string {
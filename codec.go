@@ -0,0 +1,108 @@
+package talky
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec is a wire format of the signalling messages, the clients pick one with the websocket
+// subprotocol. The hub only ever sees JSON, the codec translates the messages of its client.
+type Codec interface {
+	// Subprotocol is the websocket subprotocol which selects the codec.
+	Subprotocol() string
+
+	// FrameType is the websocket message type the codec writes, text or binary.
+	FrameType() int
+
+	// Encode encodes a message for the client.
+	Encode(msg *ResponseMessage) ([]byte, error)
+
+	// Decode turns a message of the client into the JSON the hub reads.
+	Decode(data []byte) ([]byte, error)
+}
+
+var (
+	// JSONCodec is the default wire format, used when the client doesn't ask for a subprotocol.
+	JSONCodec Codec = jsonCodec{}
+
+	// MsgpackCodec encodes the messages with MessagePack in binary frames. The messages have the
+	// same fields as their JSON counterparts.
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// codecs are the supported wire formats in the order of preference of the server.
+var codecs = []Codec{MsgpackCodec, JSONCodec}
+
+// Subprotocols are the websocket subprotocols of the supported wire formats, in the order of
+// preference of the server.
+func Subprotocols() []string {
+	protocols := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		protocols = append(protocols, codec.Subprotocol())
+	}
+
+	return protocols
+}
+
+// codecFor returns the codec of the negotiated subprotocol.
+func codecFor(subprotocol string) Codec {
+	for _, codec := range codecs {
+		if codec.Subprotocol() == subprotocol {
+			return codec
+		}
+	}
+
+	return JSONCodec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string {
+	return "talky.json"
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) Encode(msg *ResponseMessage) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Decode(data []byte) ([]byte, error) {
+	return bytes.TrimSpace(bytes.Replace(data, newline, space, -1)), nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string {
+	return "talky.msgpack"
+}
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) Encode(msg *ResponseMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(data []byte) ([]byte, error) {
+	var msg interface{}
+	if err := msgpack.Unmarshal(data, &msg); err != nil {
+		return nil, ErrMalformedMessage
+	}
+
+	return json.Marshal(msg)
+}
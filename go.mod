@@ -8,5 +8,7 @@ require (
 	github.com/go-chi/cors v1.1.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/jinzhu/gorm v1.9.12
+	github.com/prometheus/client_golang v1.7.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	golang.org/x/crypto v0.0.0-20200510223506-06a226fb4e37
 )
@@ -0,0 +1,327 @@
+package talky
+
+import (
+	"fmt"
+	"github.com/iamsayantan/talky/sdp"
+)
+
+// HandlerFunc handles a message of a client. The payload of the request is already decoded and
+// validated. The returned error is sent back to the client, nil acknowledges the message. Errors
+// which are not a *ProtocolError reach the client with the internal error code.
+//
+// Handlers run in the goroutine of the hub, so they must not block. Anything to do with a room
+// belongs in Request.InRoom.
+type HandlerFunc func(req *Request) error
+
+// Middleware wraps the handlers of all the message types, to check the user may send the message,
+// to log it and so on. The middleware runs in the hub before the payload is decoded, so the
+// payload of the request is still nil.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// PayloadFunc returns a pointer to a new payload for a message type, the payload of each message
+// of the type is decoded into it. Payloads with a Validate() error method are validated too.
+type PayloadFunc func() interface{}
+
+type handler struct {
+	newPayload PayloadFunc
+	handle     HandlerFunc
+}
+
+// Request is a message of a client on its way to the handler of its type.
+type Request struct {
+	Message *Message
+	User    *User
+	Payload interface{} // Payload is the decoded payload, as returned by the PayloadFunc of the type.
+
+	hub    *Hub
+	client *Client
+
+	// deferred is set once the request was handed to a room, which replies to the client itself.
+	deferred bool
+}
+
+// Handle registers the handler for the message type, replacing the one it had. Applications
+// embedding talky add their own message types with it. newPayload can be nil for messages without
+// a payload.
+func (h *Hub) Handle(msgType string, newPayload PayloadFunc, handle HandlerFunc) {
+	h.handlersMu.Lock()
+	defer h.handlersMu.Unlock()
+
+	h.handlers[msgType] = handler{newPayload: newPayload, handle: handle}
+}
+
+// Use adds middleware to the handlers of all the message types. Middleware added first runs first.
+func (h *Hub) Use(middleware ...Middleware) {
+	h.handlersMu.Lock()
+	defer h.handlersMu.Unlock()
+
+	h.middleware = append(h.middleware, middleware...)
+}
+
+// InRoom runs fn in the goroutine of the room, where the room may be used. The hub doesn't wait for
+// it, the client gets its reply once fn returns. When the room is removed before fn could run the
+// client is told the room was not found.
+func (r *Request) InRoom(roomID string, fn func(room *Room) error) error {
+	room, ok := r.hub.rooms[roomID]
+	if !ok {
+		return ErrRoomNotFound
+	}
+
+	posted := room.postOrDrop(func() {
+		r.client.reply(r.Message, fn(room))
+	}, func() {
+		r.client.reply(r.Message, ErrRoomNotFound)
+	})
+
+	if !posted {
+		return ErrRoomNotFound
+	}
+
+	r.deferred = true
+	return nil
+}
+
+// Send sends a message to the client the request came from.
+func (r *Request) Send(msgType string, payload interface{}) {
+	r.client.send(newResponse(msgType, payload))
+}
+
+// dispatch passes the message through the middleware to the handler of its type, which gets the
+// decoded payload. The middleware sees every message, even those of unknown types, before their
+// payload is decoded.
+func (h *Hub) dispatch(client *Client, msg *Message) {
+	h.handlersMu.RLock()
+	hd, ok := h.handlers[msg.Type]
+	middleware := h.middleware
+	h.handlersMu.RUnlock()
+
+	handle := func(req *Request) error {
+		if !ok {
+			return ErrUnknownType
+		}
+
+		if hd.newPayload != nil {
+			payload := hd.newPayload()
+			if err := decodePayload(req.Message, payload); err != nil {
+				return err
+			}
+			req.Payload = payload
+		}
+
+		return hd.handle(req)
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handle = middleware[i](handle)
+	}
+
+	req := &Request{Message: msg, User: client.user, hub: h, client: client}
+	err := handle(req)
+	if !req.deferred {
+		client.reply(msg, err)
+	}
+}
+
+// handles reports if the message type has a handler.
+func (h *Hub) handles(msgType string) bool {
+	h.handlersMu.RLock()
+	defer h.handlersMu.RUnlock()
+
+	_, ok := h.handlers[msgType]
+	return ok
+}
+
+// messageTypeLabel keeps the metric labels to the known message types, whatever the clients send.
+func (h *Hub) messageTypeLabel(msgType string) string {
+	if h.handles(msgType) {
+		return msgType
+	}
+
+	return "unknown"
+}
+
+// handleSignalling registers the handlers of the message types talky comes with.
+func (h *Hub) handleSignalling() {
+	h.Handle(Heartbeat, nil, func(req *Request) error {
+		return nil
+	})
+
+	h.Handle(CreateOrJoinRoom, func() interface{} { return &CreateOrJoinRoomMessage{} }, func(req *Request) error {
+		return h.CreateOrJoinRoom(*req.Payload.(*CreateOrJoinRoomMessage), req.client)
+	})
+
+	h.Handle(Hangup, func() interface{} { return &HangupCall{} }, func(req *Request) error {
+		return h.HandleHangup(*req.Payload.(*HangupCall), req.User)
+	})
+
+	h.Handle(Offer, func() interface{} { return &SDPMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*SDPMessage)
+		return h.inRoomWithSDP(req, payload, func(room *Room) error {
+			return room.propagateSDPOffer(*payload)
+		})
+	})
+
+	h.Handle(Answer, func() interface{} { return &SDPMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*SDPMessage)
+		return h.inRoomWithSDP(req, payload, func(room *Room) error {
+			room.sendAnswer(*payload)
+			return nil
+		})
+	})
+
+	h.Handle(ICECandidate, func() interface{} { return &ICEMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*ICEMessage)
+
+		// the target has to know who the candidate really came from, whatever the sender claims.
+		payload.User = *req.User
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			if _, ok := room.Members[req.User.ID]; !ok {
+				return ErrNotRoomMember
+			}
+
+			// an empty candidate marks the end of the candidates, there is nothing to check in it.
+			if payload.Candidate.Candidate != "" {
+				candidate, err := sdp.ParseCandidate(payload.Candidate.Candidate)
+				if err != nil {
+					return invalidPayload(err.Error())
+				}
+
+				// the candidates the other members must not see are dropped quietly, the sender
+				// can't do anything about them.
+				if !h.policy.allowCandidate(room, candidate) {
+					return nil
+				}
+				payload.Candidate.Candidate = candidate.String()
+			}
+
+			return room.sendICE(*payload)
+		})
+	})
+
+	h.Handle(KeyExchange, func() interface{} { return &KeyExchangeMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*KeyExchangeMessage)
+
+		// the members have to know who the key really came from, whatever the sender claims.
+		payload.User = *req.User
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			return room.relayKey(*payload)
+		})
+	})
+
+	h.Handle(ScreenShareStart, func() interface{} { return &ScreenShareStartMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*ScreenShareStartMessage)
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			return room.startScreenShare(req.User.ID, payload.StreamID)
+		})
+	})
+
+	h.Handle(ScreenShareStop, func() interface{} { return &ScreenShareStopMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*ScreenShareStopMessage)
+		userID := payload.UserID
+		if userID == 0 {
+			userID = req.User.ID
+		}
+
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			if err := room.stopScreenShare(userID, req.User); err != nil {
+				return err
+			}
+
+			if userID != req.User.ID {
+				h.auditor.Record(&AuditEvent{Action: AuditScreenShareStop, ActorID: req.User.ID, ActorName: req.User.Username, TargetUserID: userID, RoomID: room.ID})
+			}
+			return nil
+		})
+	})
+
+	h.Handle(Chat, func() interface{} { return &ChatMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*ChatMessage)
+		payload.User = *req.User
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			return room.sendChat(*payload)
+		})
+	})
+
+	h.Handle(HandRaise, func() interface{} { return &HandRaiseMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*HandRaiseMessage)
+		userID := payload.UserID
+		if userID == 0 {
+			userID = req.User.ID
+		}
+
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			return room.raiseHand(userID, payload.Raised, req.User)
+		})
+	})
+
+	h.Handle(MediaStateChange, func() interface{} { return &MediaStateMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*MediaStateMessage)
+		userID := payload.UserID
+		if userID == 0 {
+			userID = req.User.ID
+		}
+
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			if err := room.changeMedia(userID, payload.AudioMuted, payload.VideoMuted, req.User); err != nil {
+				return err
+			}
+
+			if userID != req.User.ID {
+				h.auditor.Record(&AuditEvent{Action: AuditMute, ActorID: req.User.ID, ActorName: req.User.Username, TargetUserID: userID, RoomID: room.ID})
+			}
+			return nil
+		})
+	})
+
+	h.Handle(MuteAll, func() interface{} { return &MuteAllMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*MuteAllMessage)
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			muted, err := room.muteAll(payload.Audio, payload.Video, req.User)
+			if err != nil {
+				return err
+			}
+
+			h.auditor.Record(&AuditEvent{Action: AuditMuteAll, ActorID: req.User.ID, ActorName: req.User.Username, RoomID: room.ID, Detail: fmt.Sprintf("%d members muted", muted)})
+			return nil
+		})
+	})
+
+	h.Handle(AudioLevel, func() interface{} { return &AudioLevelMessage{} }, func(req *Request) error {
+		payload := req.Payload.(*AudioLevelMessage)
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			return room.addAudioLevel(req.User.ID, payload.Level)
+		})
+	})
+
+	h.Handle(Stats, func() interface{} { return &StatsReport{} }, func(req *Request) error {
+		payload := req.Payload.(*StatsReport)
+		return req.InRoom(payload.RoomID, func(room *Room) error {
+			return room.addStats(req.User.ID, *payload)
+		})
+	})
+}
+
+// inRoomWithSDP runs fn in the room once the session description of the message was parsed and
+// checked against the policy of the room. The parsing is left to the room as well, so the hub isn't
+// held up by it.
+func (h *Hub) inRoomWithSDP(req *Request, payload *SDPMessage, fn func(room *Room) error) error {
+	// only the members may negotiate with each other, as who they really are.
+	payload.User = *req.User
+	return req.InRoom(payload.RoomID, func(room *Room) error {
+		if _, ok := room.Members[req.User.ID]; !ok {
+			return ErrNotRoomMember
+		}
+
+		desc, err := sdp.Parse(payload.SDP.SDP)
+		if err != nil {
+			return invalidPayload(err.Error())
+		}
+
+		if err := h.policy.sanitizeSDP(room, desc); err != nil {
+			return err
+		}
+
+		payload.SDP.SDP = desc.String()
+		return fn(room)
+	})
+}
@@ -1,11 +1,51 @@
 package talky
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
+	"github.com/iamsayantan/talky/metrics"
 	"log"
+	"sync"
 )
 
+// HubStats is a snapshot of what is going on in the hub.
+type HubStats struct {
+	ConnectedClients int              `json:"connected_clients"`
+	ActiveRooms      int              `json:"active_rooms"`
+	RoomsByType      map[RoomType]int `json:"rooms_by_type"`
+	RoomMembers      int              `json:"room_members"`
+	QueuedMessages   int              `json:"queued_messages"` // QueuedMessages are waiting in the send queues of the clients.
+}
+
+// memberQuery asks the run loop if the user is a member of the room, the answer is sent back on resultCh.
+type memberQuery struct {
+	roomID   string
+	userID   uint
+	resultCh chan *Room
+}
+
+// membersQuery asks the run loop for the room, a nil result means the room does not exist.
+type membersQuery struct {
+	roomID   string
+	resultCh chan *Room
+}
+
+// shutdownRequest asks the run loop to tell every client the server is going down, or to
+// disconnect all of them. done is closed once it is done.
+type shutdownRequest struct {
+	disconnect bool
+	done       chan struct{}
+}
+
+// moderationRequest asks the run loop to close a room or to kick a member out of it, the result
+// is sent back on errCh.
+type moderationRequest struct {
+	roomID string
+	userID uint // userID is the member to kick, zero closes the whole room.
+	errCh  chan error
+}
+
+// Hub keeps track of the connected clients and of the room every user is in. Only the run loop of
+// the hub touches them, while the rooms handle their own messages in their own goroutines.
 type Hub struct {
 	rooms       map[string]*Room
 	clients     map[uint]*Client
@@ -13,17 +53,66 @@ type Hub struct {
 
 	registerCh   chan *Client
 	unregisterCh chan *Client
+	disconnectCh chan uint
+	moderationCh chan moderationRequest
+	statsCh      chan chan HubStats
+	memberCh     chan memberQuery
+	membersCh    chan membersQuery
 	broadcastCh  chan *BroadcastMessage
+	shutdownCh   chan shutdownRequest
+
+	handlersMu sync.RWMutex
+	handlers   map[string]handler // handlers of the message types, by type.
+	middleware []Middleware
+
+	auditor  Auditor
+	recorder CallRecorder
+	policy   SignallingPolicy // policy checks the session descriptions and the candidates relayed in the rooms.
+	media    *mediaStateCache // media remembers the media state of the members who left, only the run loop uses it.
+	saving   sync.WaitGroup   // saving tracks the calls being stored in the background.
 }
 
-func NewHub() *Hub {
+// HubOption configures the optional dependencies of the hub.
+type HubOption func(*Hub)
+
+// WithAuditor makes the hub report the room joins, leaves and hangups to the auditor.
+func WithAuditor(auditor Auditor) HubOption {
+	return func(h *Hub) {
+		h.auditor = auditor
+	}
+}
+
+// WithCallRecorder makes the hub store the record of every call once its room is removed.
+func WithCallRecorder(recorder CallRecorder) HubOption {
+	return func(h *Hub) {
+		h.recorder = recorder
+	}
+}
+
+func NewHub(opts ...HubOption) *Hub {
 	hub := &Hub{
 		rooms:        make(map[string]*Room),
 		clients:      make(map[uint]*Client),
 		clientRooms:  make(map[uint]*Room),
 		registerCh:   make(chan *Client),
 		unregisterCh: make(chan *Client),
+		disconnectCh: make(chan uint),
+		moderationCh: make(chan moderationRequest),
+		statsCh:      make(chan chan HubStats),
+		memberCh:     make(chan memberQuery),
+		membersCh:    make(chan membersQuery),
 		broadcastCh:  make(chan *BroadcastMessage),
+		shutdownCh:   make(chan shutdownRequest),
+		handlers:     make(map[string]handler),
+		auditor:      NopAuditor{},
+		policy:       SignallingPolicy{Media: DefaultMediaPolicies},
+		media:        newMediaStateCache(mediaStateTTL),
+	}
+
+	hub.handleSignalling()
+
+	for _, opt := range opts {
+		opt(hub)
 	}
 
 	go hub.run()
@@ -34,188 +123,332 @@ func (h *Hub) AddClient(client *Client) {
 	h.registerCh <- client
 }
 
+// RemoveClient removes the client from its room and from the hub.
 func (h *Hub) RemoveClient(client *Client) {
-	h.RoomCleanup(client)
 	h.unregisterCh <- client
 }
 
-// RoomCleanup removes the user from any room he is part of. Also removes the room
-// from the hub if it becomes empty.
-func (h *Hub) RoomCleanup(client *Client) {
-	room, ok := h.clientRooms[client.user.ID]
-	if !ok {
-		return
+// DisconnectUser closes the connection of the user if they are connected, for example when their
+// account gets deleted.
+func (h *Hub) DisconnectUser(userID uint) {
+	h.disconnectCh <- userID
+}
+
+// CloseRoom ends the call in the room for everyone and removes the room from the hub.
+func (h *Hub) CloseRoom(roomID string) error {
+	req := moderationRequest{roomID: roomID, errCh: make(chan error, 1)}
+	h.moderationCh <- req
+	return <-req.errCh
+}
+
+// KickMember removes the user from the room. The remaining members are informed the same way
+// as if the user had hung up.
+func (h *Hub) KickMember(roomID string, userID uint) error {
+	req := moderationRequest{roomID: roomID, userID: userID, errCh: make(chan error, 1)}
+	h.moderationCh <- req
+	return <-req.errCh
+}
+
+// RoomOfMember returns the type of the room if the user is currently a member of it.
+func (h *Hub) RoomOfMember(roomID string, userID uint) (RoomType, bool) {
+	q := memberQuery{roomID: roomID, userID: userID, resultCh: make(chan *Room, 1)}
+	h.memberCh <- q
+
+	room := <-q.resultCh
+	if room == nil {
+		return "", false
 	}
 
-	_ = room.RemoveMember(client.user)
-	delete(h.clientRooms, client.user.ID)
+	return room.RoomType, true
+}
+
+// RoomMembers returns a copy of the current members of the room.
+func (h *Hub) RoomMembers(roomID string) ([]User, bool) {
+	q := membersQuery{roomID: roomID, resultCh: make(chan *Room, 1)}
+	h.membersCh <- q
 
-	// remove empty rooms from the memory.
-	if len(room.Members) == 0 {
-		log.Printf("Room %s is empty, removing from the Hub", room.ID)
-		delete(h.rooms, room.ID)
+	room := <-q.resultCh
+	if room == nil {
+		return nil, false
 	}
+
+	var members []User
+	ok := room.do(func() {
+		members = room.members()
+	})
+	return members, ok
+}
+
+// Stats returns the current statistics of the hub.
+func (h *Hub) Stats() HubStats {
+	ch := make(chan HubStats, 1)
+	h.statsCh <- ch
+	return <-ch
+}
+
+// StatsContext returns the current statistics of the hub, unless the context is done before the
+// run loop gets to it.
+func (h *Hub) StatsContext(ctx context.Context) (HubStats, error) {
+	ch := make(chan HubStats, 1)
+	select {
+	case h.statsCh <- ch:
+	case <-ctx.Done():
+		return HubStats{}, ctx.Err()
+	}
+
+	select {
+	case stats := <-ch:
+		return stats, nil
+	case <-ctx.Done():
+		return HubStats{}, ctx.Err()
+	}
+}
+
+// Ping checks the run loop of the hub is still responding.
+func (h *Hub) Ping(ctx context.Context) error {
+	_, err := h.StatsContext(ctx)
+	return err
+}
+
+// NotifyShutdown tells every connected client the server is going down, so they can reconnect
+// to another one while their calls go on.
+func (h *Hub) NotifyShutdown() {
+	req := shutdownRequest{done: make(chan struct{})}
+	h.shutdownCh <- req
+	<-req.done
+}
+
+// DisconnectAll ends every call and closes the connection of every client. It returns once the
+// records of the calls are stored.
+func (h *Hub) DisconnectAll() {
+	req := shutdownRequest{disconnect: true, done: make(chan struct{})}
+	h.shutdownCh <- req
+	<-req.done
+
+	h.saving.Wait()
 }
 
 // CreateOrJoinRoom either creates a room if it does not exist in the hub and then adds the
-// user to the room. If room already exists, then it just adds the user to the room.
-func (h *Hub) CreateOrJoinRoom(payload CreateOrJoinRoomMessage, user *User) error {
+// user to the room. If room already exists, then it just adds the user to the room. The hub waits
+// for the room, so the membership of the user is settled before the next message.
+func (h *Hub) CreateOrJoinRoom(payload CreateOrJoinRoomMessage, client *Client) error {
+	user := client.user
+	if !user.HasScope(ScopeJoinRoom) {
+		return ErrMissingScope
+	}
+
+	if user.Guest && payload.RoomID != user.GuestRoomID {
+		return ErrGuestRoom
+	}
+
+	// at a time a single user can be part of only one room.
+	if existingRoom, ok := h.clientRooms[user.ID]; ok && existingRoom.ID != payload.RoomID {
+		return ErrInAnotherRoom
+	}
+
 	// isInitiator is used to track if the room is initiated by the user, if a room is not available in the
 	// room list in hub, then we assume the first user a initiator.
 	isInitiator := false
 	room, ok := h.rooms[payload.RoomID]
 	if !ok {
+		// guests are invited to an ongoing call, they can't start a new one.
+		if user.Guest {
+			return ErrRoomNotFound
+		}
+
 		isInitiator = true
 		room = NewRoom(payload.RoomType, payload.RoomID)
+		room.RelayOnly = payload.RelayOnly
+		room.E2EE = payload.E2EE
+		room.Host = user.ID
+		room.MaxScreenShares = h.policy.screenShares(payload.RoomType)
 		h.rooms[room.ID] = room
 	}
 
-	// at a time a single user can be part of only one room.
-	if existingRoom, ok := h.clientRooms[user.ID]; ok && existingRoom.ID != room.ID {
-		return errors.New("you are already a part of a room")
+	// a member joining again, like after losing their connection, keeps what they had muted.
+	media := payload.MediaState
+	if saved, ok := h.media.get(room.ID, user.ID); ok {
+		media.AudioMuted = media.AudioMuted || saved.AudioMuted
+		media.VideoMuted = media.VideoMuted || saved.VideoMuted
 	}
 
-	err := room.AddMember(user)
+	var err error
+	room.do(func() {
+		err = room.join(client, isInitiator, media)
+	})
+
 	if err != nil {
 		log.Printf("Error while adding user to room: %v", err)
+		if isInitiator {
+			delete(h.rooms, room.ID)
+			room.stop()
+		}
 		return err
 	}
 
 	h.clientRooms[user.ID] = room
+	h.media.forget(room.ID, user.ID)
+	h.auditor.Record(&AuditEvent{Action: AuditRoomJoin, ActorID: user.ID, ActorName: user.Username, RoomID: room.ID})
+	return nil
+}
 
-	roomJoined := RoomJoined{
-		RoomID:      room.ID,
-		User:        *user,
-		IsInitiator: isInitiator,
-	}
-
-	responsePayload := ResponseMessage{
-		Type:    RoomJoin,
-		Payload: roomJoined,
+// HandleHangup removes the user from their room and tells the remaining members. The members are
+// told who hung up and in which room by the hub, not by the payload the client sent.
+func (h *Hub) HandleHangup(payload HangupCall, user *User) error {
+	room, ok := h.clientRooms[user.ID]
+	if !ok {
+		return nil
 	}
 
-	resp, _ := json.Marshal(responsePayload)
-
-	// RoomJoin message should be broadcast to all users in the room.
-	for _, member := range room.Members {
-		if client, ok := h.clients[member.ID]; ok {
-			client.sendCh <- resp
-		}
+	hangup := newResponse(Hangup, HangupCall{RoomID: room.ID, UserID: user.ID})
+	if h.leaveRoom(user.ID, hangup) != nil {
+		h.auditor.Record(&AuditEvent{Action: AuditHangup, ActorID: user.ID, ActorName: user.Username, RoomID: room.ID})
 	}
 
 	return nil
 }
 
-func (h *Hub) HandleHangup(payload HangupCall, user *User) error {
-	room, ok := h.clientRooms[payload.UserID]
+// leaveRoom removes the user from the room they are part of and sends the hangup message, unless
+// it is nil, to the remaining members. Also removes the room from the hub if it becomes empty. It
+// returns the room the user left, if any.
+func (h *Hub) leaveRoom(userID uint, hangup *ResponseMessage) *Room {
+	room, ok := h.clientRooms[userID]
 	if !ok {
 		return nil
 	}
 
-	err := room.RemoveMember(user)
-	if err != nil {
-		log.Printf("Error while removing user from room: %v", err)
-		return err
-	}
-	delete(h.clientRooms, user.ID)
+	delete(h.clientRooms, userID)
+
+	remaining := 0
+	var media MediaState
+	var member bool
+	room.do(func() {
+		media, member = room.mediaOf(userID)
+		remaining = room.leave(userID, hangup, KeyRotationLeave)
+	})
 
-	responsePayload := ResponseMessage{
-		Type:    Hangup,
-		Payload: payload,
+	if member {
+		h.media.put(room.ID, userID, media)
 	}
 
-	resp, _ := json.Marshal(responsePayload)
-	for _, member := range room.Members {
-		if client, ok := h.clients[member.ID]; ok {
-			if client.user.ID == user.ID {
-				continue
-			}
-			client.sendCh <- resp
-		}
+	h.removeIfEmpty(room, remaining)
+	return room
+}
+
+// removeIfEmpty removes empty rooms from the memory.
+func (h *Hub) removeIfEmpty(room *Room, members int) {
+	if members > 0 {
+		return
 	}
 
-	return nil
+	log.Printf("Room %s is empty, removing from the Hub", room.ID)
+	h.removeRoom(room)
 }
 
-func (h *Hub) PropagateSDPOffer(payload SDPMessage) error {
-	room, ok := h.rooms[payload.RoomID]
-	if !ok {
-		return errors.New("room not found")
+// removeRoom removes the room from the hub, stops it and stores the record of its call in the
+// background.
+func (h *Hub) removeRoom(room *Room) {
+	delete(h.rooms, room.ID)
+
+	var call *Call
+	room.do(func() {
+		call = room.endCall()
+	})
+	room.stop()
+
+	if h.recorder == nil || call == nil {
+		return
 	}
 
-	responsePayload := ResponseMessage{
-		Type:    Offer,
-		Payload: payload,
+	h.saving.Add(1)
+	go func() {
+		defer h.saving.Done()
+		if err := h.recorder.CreateCall(call); err != nil {
+			log.Printf("Error storing the call of room %s: %v", call.RoomID, err)
+		}
+	}()
+}
+
+// disconnect removes the client from its room and from the hub, then closes it.
+func (h *Hub) disconnect(client *Client) {
+	user := client.user
+	if room := h.leaveRoom(user.ID, nil); room != nil {
+		h.auditor.Record(&AuditEvent{Action: AuditRoomLeave, ActorID: user.ID, ActorName: user.Username, RoomID: room.ID})
 	}
 
-	resp, _ := json.Marshal(responsePayload)
+	delete(h.clients, user.ID)
+	client.close()
+}
 
-	member, ok := room.Members[payload.TargetUserID]
+func (h *Hub) closeRoom(roomID string) error {
+	room, ok := h.rooms[roomID]
 	if !ok {
-		return errors.New("member not found")
+		return ErrRoomNotFound
 	}
 
-	client, ok := h.clients[member.ID]
-	if !ok {
-		return errors.New("client not found.")
+	var members []uint
+	room.do(func() {
+		members = room.close()
+	})
+
+	for _, id := range members {
+		delete(h.clientRooms, id)
 	}
 
-	client.sendCh <- resp
+	h.removeRoom(room)
 	return nil
 }
 
-func (h *Hub) SendAnswer(payload SDPMessage) error {
-	room, ok := h.rooms[payload.RoomID]
+func (h *Hub) kickMember(roomID string, userID uint) error {
+	room, ok := h.rooms[roomID]
 	if !ok {
-		return errors.New("room not found")
+		return ErrRoomNotFound
 	}
 
-	responsePayload := ResponseMessage{
-		Type:    Answer,
-		Payload: payload,
+	if h.clientRooms[userID] != room {
+		return ErrNotRoomMember
 	}
 
-	resp, _ := json.Marshal(responsePayload)
-	for _, member := range room.Members {
-		if client, ok := h.clients[member.ID]; ok {
-			// answers should only be sent to the targeted user.
-			if payload.TargetUserID == 0 || client.user.ID != payload.TargetUserID {
-				log.Printf("Skipping sending answer to %d", client.user.ID)
-				continue
-			}
+	delete(h.clientRooms, userID)
 
-			log.Printf("Sending answer to %d", client.user.ID)
-			client.sendCh <- resp
-		}
+	kicked := newResponse(Kicked, KickedMessage{RoomID: room.ID})
+
+	hangup := newResponse(Hangup, HangupCall{RoomID: room.ID, UserID: userID})
+
+	remaining := 0
+	var media MediaState
+	var member bool
+	room.do(func() {
+		_ = room.sendTo(userID, kicked)
+		media, member = room.mediaOf(userID)
+		remaining = room.leave(userID, hangup, KeyRotationKick)
+	})
+
+	if member {
+		h.media.put(room.ID, userID, media)
 	}
 
+	h.removeIfEmpty(room, remaining)
 	return nil
 }
 
-func (h *Hub) SendICE(payload ICEMessage) error {
-	room, ok := h.rooms[payload.RoomID]
-	if !ok {
-		return errors.New("room not found")
+func (h *Hub) stats() HubStats {
+	stats := HubStats{
+		ConnectedClients: len(h.clients),
+		ActiveRooms:      len(h.rooms),
+		RoomsByType:      make(map[RoomType]int),
+		RoomMembers:      len(h.clientRooms),
 	}
 
-	responsePayload := ResponseMessage{
-		Type:    ICECandidate,
-		Payload: payload,
-	}
-	resp, _ := json.Marshal(responsePayload)
-	member, ok := room.Members[payload.TargetUserID]
-	if !ok {
-		return errors.New("member not found")
+	for _, room := range h.rooms {
+		stats.RoomsByType[room.RoomType]++
 	}
 
-	client, ok := h.clients[member.ID]
-	if !ok {
-		return errors.New("client not found.")
+	for _, client := range h.clients {
+		stats.QueuedMessages += client.queue.len()
 	}
 
-	client.sendCh <- resp
-
-	return nil
+	return stats
 }
 
 func (h *Hub) run() {
@@ -223,101 +456,92 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.registerCh:
 			log.Printf("Registering new client with user id: %d", client.user.ID)
+			if old, ok := h.clients[client.user.ID]; ok && old != client {
+				old.send(newResponse(Error, ErrorMessage{Code: CodeConnectionReplaced, Message: ErrConnectionReplaced.Error()}))
+				old.close()
+			}
 			h.clients[client.user.ID] = client
+
+			// a user who connects again while in a call keeps the call on the new connection.
+			if room, ok := h.clientRooms[client.user.ID]; ok {
+				room.post(func() {
+					room.attach(client)
+				})
+			}
 		case client := <-h.unregisterCh:
 			log.Printf("Removing client with user id: %d", client.user.ID)
-			if _, ok := h.clients[client.user.ID]; ok {
-				delete(h.clients, client.user.ID)
-				close(client.sendCh)
+			// the user may have connected again in the meantime, the new client must stay.
+			if current, ok := h.clients[client.user.ID]; ok && current == client {
+				h.disconnect(client)
+			} else {
+				client.close()
 			}
-		case broadcastMessage := <-h.broadcastCh:
-			var msg *Message
-			if err := json.Unmarshal(broadcastMessage.Payload, &msg); err != nil {
-				log.Printf("Error unmarshalling websocket message: %v", err)
+		case userID := <-h.disconnectCh:
+			// closing the send queue makes the write pump close the connection.
+			if client, ok := h.clients[userID]; ok {
+				log.Printf("Disconnecting client with user id: %d", userID)
+				h.disconnect(client)
 			}
-
-			switch msg.Type {
-			case CreateOrJoinRoom:
-				var payload CreateOrJoinRoomMessage
-				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("Error unmarshalling websocket payload: %v", err)
+		case req := <-h.shutdownCh:
+			if req.disconnect {
+				log.Printf("Disconnecting all %d clients", len(h.clients))
+				for _, client := range h.clients {
+					h.disconnect(client)
 				}
+			} else {
+				resp := newResponse(ServerShutdown, ServerShutdownMessage{Message: "server is shutting down, please reconnect", Reconnect: true})
 
-				err := h.CreateOrJoinRoom(payload, broadcastMessage.User)
-				if err != nil {
-					errPayload := ResponseMessage{
-						Type:    "error",
-						Payload: err.Error(),
-					}
-
-					msg, _ := json.Marshal(errPayload)
-					h.clients[broadcastMessage.User.ID].sendCh <- msg
-				}
-			case Hangup:
-				var payload HangupCall
-				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("Error unmarshalling websocket paylaod: %v", err)
-				}
-
-				err := h.HandleHangup(payload, broadcastMessage.User)
-				if err != nil {
-					errPayload := ResponseMessage{
-						Type:    "error",
-						Payload: err.Error(),
-					}
-
-					msg, _ := json.Marshal(errPayload)
-					h.clients[broadcastMessage.User.ID].sendCh <- msg
-				}
-			case Offer:
-				var payload SDPMessage
-				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("Error unmarshalling websocket paylaod: %v", err)
-				}
-
-				err := h.PropagateSDPOffer(payload)
-				if err != nil {
-					errPayload := ResponseMessage{
-						Type:    "error",
-						Payload: err.Error(),
-					}
-
-					msg, _ := json.Marshal(errPayload)
-					h.clients[broadcastMessage.User.ID].sendCh <- msg
-				}
-			case Answer:
-				var payload SDPMessage
-				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("Error unmarshalling websocket paylaod: %v", err)
+				for _, client := range h.clients {
+					client.send(resp)
 				}
+			}
+			close(req.done)
+		case req := <-h.moderationCh:
+			if req.userID == 0 {
+				req.errCh <- h.closeRoom(req.roomID)
+			} else {
+				req.errCh <- h.kickMember(req.roomID, req.userID)
+			}
+		case ch := <-h.statsCh:
+			ch <- h.stats()
+		case q := <-h.memberCh:
+			room, ok := h.clientRooms[q.userID]
+			if !ok || room.ID != q.roomID {
+				room = nil
+			}
+			q.resultCh <- room
+		case q := <-h.membersCh:
+			q.resultCh <- h.rooms[q.roomID]
+		case broadcastMessage := <-h.broadcastCh:
+			h.route(broadcastMessage)
+		}
+	}
+}
 
-				err := h.SendAnswer(payload)
-				if err != nil {
-					errPayload := ResponseMessage{
-						Type:    "error",
-						Payload: err.Error(),
-					}
+// route passes the message on to the handler of its type. Every message is acknowledged or
+// answered with an error.
+func (h *Hub) route(broadcastMessage *BroadcastMessage) {
+	client := broadcastMessage.client
 
-					msg, _ := json.Marshal(errPayload)
-					h.clients[broadcastMessage.User.ID].sendCh <- msg
-				}
-			case ICECandidate:
-				var payload ICEMessage
-				if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-					log.Printf("Error unmarshalling websocket paylaod: %v", err)
-				}
+	// messages still on their way from a client which was disconnected, or replaced by a newer
+	// connection of the user, are dropped. They could put the user back in a room nobody takes
+	// them out of. Those clients are closed already, the replaced ones were told why.
+	if current, ok := h.clients[client.user.ID]; !ok || current != client {
+		return
+	}
 
-				err := h.SendICE(payload)
-				if err != nil {
-					errPayload := ResponseMessage{
-						Type:    "error",
-						Payload: err.Error(),
-					}
+	msg, err := decodeMessage(broadcastMessage.Payload)
+	msgType := ""
+	if msg != nil {
+		msgType = msg.Type
+	}
 
-					msg, _ := json.Marshal(errPayload)
-					h.clients[broadcastMessage.User.ID].sendCh <- msg
-				}
-			}
-		}
+	metrics.HubMessages.WithLabelValues(h.messageTypeLabel(msgType)).Inc()
+	if err != nil {
+		log.Printf("Invalid websocket message from user %d: %v", client.user.ID, err)
+		client.reply(msg, err)
+		return
 	}
+
+	h.dispatch(client, msg)
 }
@@ -0,0 +1,160 @@
+package talky
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stressErrorCodes are the errors the clients of the stress test may get, as their rooms fill up,
+// are closed or lose the members they signal to.
+var stressErrorCodes = map[ErrorCode]bool{
+	CodeRoomFull:      true,
+	CodeRoomNotFound:  true,
+	CodeNotRoomMember: true,
+}
+
+// collect reads the messages of the client until every request got its reply. Each request has to
+// get exactly one, an ACK or an error.
+func (c *testClient) collect(ids []string) (map[string]*ErrorMessage, error) {
+	replies := make(map[string]*ErrorMessage, len(ids))
+	waiting := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		waiting[id] = true
+	}
+
+	timeout := time.After(10 * time.Second)
+	for len(waiting) > 0 {
+		for _, msg := range c.pending {
+			var id string
+			var errMsg *ErrorMessage
+			switch payload := msg.Payload.(type) {
+			case AckMessage:
+				id = payload.RequestID
+			case ErrorMessage:
+				id, errMsg = payload.RequestID, &payload
+			default:
+				continue
+			}
+
+			if _, ok := replies[id]; ok {
+				return nil, fmt.Errorf("user %d got more than one reply to %s", c.user.ID, id)
+			}
+			replies[id] = errMsg
+			delete(waiting, id)
+		}
+		c.pending = nil
+
+		if len(waiting) == 0 {
+			break
+		}
+
+		select {
+		case <-c.queue.ready:
+			c.pending, _ = c.queue.pop()
+		case <-timeout:
+			return nil, fmt.Errorf("user %d got no reply to %d of its %d requests", c.user.ID, len(waiting), len(ids))
+		}
+	}
+
+	return replies, nil
+}
+
+// TestHubStress has many clients join and leave rooms and signal each other at the same time, while
+// the rooms are closed and their members kicked under them. Run it with -race.
+func TestHubStress(t *testing.T) {
+	clients, rounds, rooms := 200, 10, 20
+	if testing.Short() {
+		clients, rounds = 50, 4
+	}
+
+	hub := NewHub()
+	done := make(chan struct{})
+
+	// the moderation and the queries from outside the hub race with the work queued in the rooms.
+	var moderation sync.WaitGroup
+	moderation.Add(1)
+	go func() {
+		defer moderation.Done()
+		rnd := rand.New(rand.NewSource(1))
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			roomID := fmt.Sprintf("room-%d", rnd.Intn(rooms))
+			switch rnd.Intn(4) {
+			case 0:
+				_ = hub.CloseRoom(roomID)
+			case 1:
+				_ = hub.KickMember(roomID, uint(rnd.Intn(clients)+1))
+			case 2:
+				hub.RoomMembers(roomID)
+			default:
+				hub.Stats()
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 1; i <= clients; i++ {
+		user := &User{ID: uint(i), Username: fmt.Sprintf("user-%d", i)}
+		client := newTestClient(t, hub, user)
+
+		wg.Add(1)
+		go func(c *testClient) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(c.user.ID)))
+			muted := true
+
+			for round := 0; round < rounds; round++ {
+				roomID := fmt.Sprintf("room-%d", rnd.Intn(rooms))
+				target := uint(rnd.Intn(clients) + 1)
+
+				// the requests are not waited for one by one, so they pile up in the mailbox of the
+				// room while it may be closed.
+				ids := []string{
+					c.request(CreateOrJoinRoom, CreateOrJoinRoomMessage{RoomID: roomID, RoomType: AudioRoom}),
+					c.request(ICECandidate, endOfCandidates(roomID, *c.user, target)),
+					c.request(Chat, ChatMessage{RoomID: roomID, Text: "hello"}),
+					c.request(MediaStateChange, MediaStateMessage{RoomID: roomID, UserID: c.user.ID, AudioMuted: &muted}),
+					c.request(AudioLevel, AudioLevelMessage{RoomID: roomID, Level: rnd.Float64()}),
+					c.request(Hangup, HangupCall{RoomID: roomID, UserID: c.user.ID}),
+				}
+
+				replies, err := c.collect(ids)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				for id, reply := range replies {
+					if reply != nil && !stressErrorCodes[reply.Code] {
+						errs <- fmt.Errorf("user %d got %s for %s: %s", c.user.ID, reply.Code, id, reply.Message)
+						return
+					}
+				}
+			}
+		}(client)
+	}
+
+	wg.Wait()
+	close(done)
+	moderation.Wait()
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// everyone hung up in the end, so every room is gone.
+	if stats := hub.Stats(); stats.ActiveRooms != 0 || stats.RoomMembers != 0 {
+		t.Errorf("%d rooms with %d members are left, want none", stats.ActiveRooms, stats.RoomMembers)
+	}
+}
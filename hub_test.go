@@ -0,0 +1,194 @@
+package talky
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the hub and the rooms log every join and leave, which buries the output of the tests.
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testClient is a client without a connection. Its messages are handed straight to the hub and
+// what the hub sends it is read from its send queue.
+type testClient struct {
+	*Client
+	t       *testing.T
+	nextID  int
+	pending []*ResponseMessage
+}
+
+func newTestClient(t *testing.T, hub *Hub, user *User) *testClient {
+	client := &Client{hub: hub, user: user, codec: JSONCodec, queue: newSendQueue(1 << 16)}
+	hub.AddClient(client)
+	return &testClient{Client: client, t: t}
+}
+
+// request sends the message to the hub and returns its id.
+func (c *testClient) request(msgType string, payload interface{}) string {
+	c.nextID++
+	id := fmt.Sprintf("%d-%d", c.user.ID, c.nextID)
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		c.t.Fatalf("encoding %s payload: %v", msgType, err)
+	}
+
+	msg, err := json.Marshal(Message{ID: id, Type: msgType, Payload: data})
+	if err != nil {
+		c.t.Fatalf("encoding %s message: %v", msgType, err)
+	}
+
+	c.hub.broadcastCh <- &BroadcastMessage{User: c.user, Payload: msg, client: c.Client}
+	return id
+}
+
+// result waits for the reply to the request, it returns nil for an ACK.
+func (c *testClient) result(id string) *ErrorMessage {
+	for {
+		msg := c.next()
+		switch payload := msg.Payload.(type) {
+		case AckMessage:
+			if payload.RequestID == id {
+				return nil
+			}
+		case ErrorMessage:
+			if payload.RequestID == id {
+				return &payload
+			}
+		}
+	}
+}
+
+// expect waits for the next message of the type, the messages of the other types are skipped.
+func (c *testClient) expect(msgType string) *ResponseMessage {
+	for {
+		if msg := c.next(); msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// next waits for the next message sent to the client.
+func (c *testClient) next() *ResponseMessage {
+	timeout := time.After(5 * time.Second)
+	for len(c.pending) == 0 {
+		select {
+		case <-c.queue.ready:
+			c.pending, _ = c.queue.pop()
+		case <-timeout:
+			c.t.Fatalf("user %d got no message", c.user.ID)
+		}
+	}
+
+	msg := c.pending[0]
+	c.pending = c.pending[1:]
+	return msg
+}
+
+// join makes the client join the room and fails the test if it can't.
+func (c *testClient) join(roomID string) {
+	id := c.request(CreateOrJoinRoom, CreateOrJoinRoomMessage{RoomID: roomID, RoomType: AudioRoom})
+	if err := c.result(id); err != nil {
+		c.t.Fatalf("user %d joining room %s: %s", c.user.ID, roomID, err.Message)
+	}
+}
+
+func endOfCandidates(roomID string, user User, target uint) ICEMessage {
+	mid := "0"
+	return ICEMessage{
+		RoomMessage: RoomMessage{RoomID: roomID, User: user, TargetUserID: target},
+		Candidate:   &ICECandidateInit{SDPMid: &mid},
+	}
+}
+
+func TestSignallingRequiresMembership(t *testing.T) {
+	hub := NewHub()
+	alice := newTestClient(t, hub, &User{ID: 1, Username: "alice"})
+	bob := newTestClient(t, hub, &User{ID: 2, Username: "bob"})
+	mallory := newTestClient(t, hub, &User{ID: 3, Username: "mallory"})
+
+	alice.join("room-a")
+	bob.join("room-a")
+	mallory.join("room-b")
+
+	offer := SDPMessage{
+		RoomMessage: RoomMessage{RoomID: "room-a", User: User{ID: 1}, TargetUserID: 2},
+		SDP:         &SessionDescription{Type: "offer", SDP: "v=0"},
+	}
+
+	tests := []struct {
+		msgType string
+		payload interface{}
+	}{
+		{Offer, offer},
+		{Answer, offer},
+		{ICECandidate, endOfCandidates("room-a", User{ID: 1}, 2)},
+	}
+
+	for _, tt := range tests {
+		err := mallory.result(mallory.request(tt.msgType, tt.payload))
+		if err == nil || err.Code != CodeNotRoomMember {
+			t.Errorf("%s to a room of others got %+v, want %s", tt.msgType, err, CodeNotRoomMember)
+		}
+	}
+
+	// the members get the candidates as sent by who really sent them.
+	if err := bob.result(bob.request(ICECandidate, endOfCandidates("room-a", User{ID: 1, Username: "alice"}, 1))); err != nil {
+		t.Fatalf("ICE candidate between members: %s", err.Message)
+	}
+
+	got := alice.expect(ICECandidate).Payload.(ICEMessage)
+	if got.User.ID != bob.user.ID {
+		t.Errorf("ICE candidate relayed as user %d, want %d", got.User.ID, bob.user.ID)
+	}
+}
+
+func TestHangupTellsWhoReallyLeft(t *testing.T) {
+	hub := NewHub()
+	alice := newTestClient(t, hub, &User{ID: 1, Username: "alice"})
+	bob := newTestClient(t, hub, &User{ID: 2, Username: "bob"})
+
+	alice.join("room-a")
+	bob.join("room-a")
+
+	// bob claims alice hung up in another room.
+	if err := bob.result(bob.request(Hangup, HangupCall{RoomID: "room-b", UserID: 1})); err != nil {
+		t.Fatalf("hangup: %s", err.Message)
+	}
+
+	got := alice.expect(Hangup).Payload.(HangupCall)
+	if got.RoomID != "room-a" || got.UserID != bob.user.ID {
+		t.Errorf("hangup relayed as user %d in room %s, want user %d in room-a", got.UserID, got.RoomID, bob.user.ID)
+	}
+}
+
+func TestReconnectClosesReplacedClient(t *testing.T) {
+	hub := NewHub()
+	user := &User{ID: 1, Username: "alice"}
+	old := newTestClient(t, hub, user)
+	old.join("room-a")
+
+	fresh := newTestClient(t, hub, user)
+
+	got := old.expect(Error).Payload.(ErrorMessage)
+	if got.Code != CodeConnectionReplaced {
+		t.Errorf("replaced client got %s, want %s", got.Code, CodeConnectionReplaced)
+	}
+
+	if _, closed := old.queue.pop(); !closed {
+		t.Error("send queue of the replaced client is still open")
+	}
+
+	// the call goes on over the new connection.
+	if err := fresh.result(fresh.request(Hangup, HangupCall{RoomID: "room-a"})); err != nil {
+		t.Errorf("hangup over the new connection: %s", err.Message)
+	}
+}
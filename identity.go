@@ -0,0 +1,69 @@
+package talky
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// The algorithms of the identity keys. The public keys are sent in the raw format WebCrypto exports
+// them in, base64 encoded.
+const (
+	IdentityKeyP256    = "P-256"   // IdentityKeyP256 keys are uncompressed curve points of 65 bytes.
+	IdentityKeyX25519  = "X25519"  // IdentityKeyX25519 keys are 32 bytes.
+	IdentityKeyEd25519 = "Ed25519" // IdentityKeyEd25519 keys are 32 bytes.
+)
+
+// ErrInvalidIdentityKey is returned for a public key which doesn't fit its algorithm.
+var ErrInvalidIdentityKey = errors.New("invalid identity key")
+
+// identityKeyLengths are the lengths of the raw public keys by algorithm.
+var identityKeyLengths = map[string]int{
+	IdentityKeyP256:    65,
+	IdentityKeyX25519:  32,
+	IdentityKeyEd25519: 32,
+}
+
+// IdentityKey is the long term public key of a user. The members of the end-to-end encrypted rooms
+// use them to encrypt their media keys for each other, so the server only ever relays keys it can't
+// read. The private keys never leave the devices of the users.
+type IdentityKey struct {
+	ID          uint      `gorm:"primary_key" json:"-"`
+	UserID      uint      `gorm:"unique_index" json:"user_id"`
+	Algorithm   string    `gorm:"type:varchar(16)" json:"algorithm"`
+	PublicKey   string    `gorm:"type:varchar(128)" json:"public_key"`
+	Fingerprint string    `gorm:"type:varchar(64)" json:"fingerprint"` // Fingerprint is the hex encoded sha256 hash of the raw public key.
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// NewIdentityKey checks the base64 encoded public key fits the algorithm and returns the identity key
+// of the user.
+func NewIdentityKey(userID uint, algorithm, publicKey string) (*IdentityKey, error) {
+	length, ok := identityKeyLengths[algorithm]
+	if !ok {
+		return nil, errors.New("identity key algorithm must be P-256, X25519 or Ed25519")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(raw) != length {
+		return nil, ErrInvalidIdentityKey
+	}
+
+	if algorithm == IdentityKeyP256 {
+		if x, _ := elliptic.Unmarshal(elliptic.P256(), raw); x == nil {
+			return nil, ErrInvalidIdentityKey
+		}
+	}
+
+	sum := sha256.Sum256(raw)
+	return &IdentityKey{
+		UserID:      userID,
+		Algorithm:   algorithm,
+		PublicKey:   publicKey,
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}, nil
+}
@@ -0,0 +1,82 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/smtp"
+	"strings"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to the users.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// errHeaderInjection is returned for a message whose headers would break out into new lines.
+var errHeaderInjection = errors.New("mail header contains a line break")
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from *mail.Address // from is the sender, its plain address is the envelope sender.
+}
+
+// NewSMTPMailer creates a Mailer which delivers the messages through the SMTP server at host:port.
+// Authentication is skipped when the username is empty, which is handy for a local SMTP sink. The
+// sender may have a display name, like talky <no-reply@example.com>.
+func NewSMTPMailer(host string, port int, username, password, from string) (Mailer, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address %s: %w", from, err)
+	}
+
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &smtpMailer{
+		addr: fmt.Sprintf("%s:%d", host, port),
+		auth: auth,
+		from: sender,
+	}, nil
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return errHeaderInjection
+	}
+
+	var b strings.Builder
+	b.WriteString("From: " + m.from.String() + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + msg.Subject + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+
+	return smtp.SendMail(m.addr, m.auth, m.from.Address, []string{msg.To}, []byte(b.String()))
+}
+
+type logMailer struct{}
+
+// NewLogMailer creates a Mailer which only writes the messages to the log, useful for development
+// when there is no SMTP server around.
+func NewLogMailer() Mailer {
+	return &logMailer{}
+}
+
+func (m *logMailer) Send(msg Message) error {
+	log.Printf("Sending mail to %s, subject: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -0,0 +1,125 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSink is an SMTP server which accepts every message and keeps what it got.
+type smtpSink struct {
+	ln       net.Listener
+	mailFrom chan string
+	rcptTo   chan string
+	data     chan string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	s := &smtpSink{ln: ln, mailFrom: make(chan string, 1), rcptTo: make(chan string, 1), data: make(chan string, 1)}
+	go s.serve()
+	return s
+}
+
+func (s *smtpSink) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpSink) serve() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP sink")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			tp.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			s.mailFrom <- line[len("MAIL FROM:"):]
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			s.rcptTo <- line[len("RCPT TO:"):]
+			tp.PrintfLine("250 OK")
+		case cmd == "DATA":
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			lines, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.data <- strings.Join(lines, "\n")
+			tp.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	sink := newSMTPSink(t)
+	defer sink.ln.Close()
+
+	mailer, err := NewSMTPMailer("127.0.0.1", sink.port(), "", "", "talky <no-reply@localhost>")
+	if err != nil {
+		t.Fatalf("NewSMTPMailer: %v", err)
+	}
+
+	err = mailer.Send(Message{To: "alice@example.com", Subject: "Verify your email", Body: "hello"})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if from := <-sink.mailFrom; from != "<no-reply@localhost>" {
+		t.Errorf("MAIL FROM = %s, want <no-reply@localhost>", from)
+	}
+	if to := <-sink.rcptTo; to != "<alice@example.com>" {
+		t.Errorf("RCPT TO = %s, want <alice@example.com>", to)
+	}
+
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(<-sink.data + "\n"))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("read headers: %v", err)
+	}
+	if from := msg.Get("From"); from != `"talky" <no-reply@localhost>` {
+		t.Errorf("From = %s, want the sender with its name", from)
+	}
+	if subject := msg.Get("Subject"); subject != "Verify your email" {
+		t.Errorf("Subject = %s, want Verify your email", subject)
+	}
+}
+
+func TestSMTPMailerInvalidSender(t *testing.T) {
+	if _, err := NewSMTPMailer("127.0.0.1", 25, "", "", "talky <no-reply"); err == nil {
+		t.Error("NewSMTPMailer accepted an invalid sender")
+	}
+}
+
+func TestSMTPMailerHeaderInjection(t *testing.T) {
+	mailer, err := NewSMTPMailer("127.0.0.1", 25, "", "", "no-reply@localhost")
+	if err != nil {
+		t.Fatalf("NewSMTPMailer: %v", err)
+	}
+
+	err = mailer.Send(Message{To: "alice@example.com", Subject: "hi\r\nBcc: mallory@example.com", Body: "hello"})
+	if err != errHeaderInjection {
+		t.Errorf("Send = %v, want %v", err, errHeaderInjection)
+	}
+}
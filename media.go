@@ -0,0 +1,148 @@
+package talky
+
+import (
+	"fmt"
+	"github.com/iamsayantan/talky/metrics"
+	"github.com/iamsayantan/talky/sdp"
+	"strings"
+)
+
+// MediaPolicy limits what the session descriptions in the rooms of a room type may contain.
+type MediaPolicy struct {
+	// Media are the kinds of the media sections allowed, like audio, video or application.
+	Media []string
+
+	// Codecs are the names of the codecs allowed by the kind of the media, like opus for audio or VP8
+	// for video. The others are removed from the session descriptions, so the helper codecs like rtx
+	// or red have to be listed as well. The kinds missing from it allow every codec.
+	Codecs map[string][]string
+
+	// ScreenShares is how many members may share their screen at the same time, zero doesn't allow
+	// screen sharing. The screens are sent as video tracks, so the video media has to be allowed too.
+	ScreenShares int
+}
+
+// DefaultMediaPolicies keep the video and the screen shares out of the audio rooms.
+var DefaultMediaPolicies = map[RoomType]MediaPolicy{
+	AudioRoom:      {Media: []string{"audio"}},
+	AudioVideoRoom: {Media: []string{"audio", "video"}, ScreenShares: 1},
+}
+
+// defaultScreenShares is how many screens may be shared at the same time in the rooms whose room
+// type has no media policy.
+const defaultScreenShares = 1
+
+// SignallingPolicy decides how the session descriptions and the ICE candidates are checked and
+// cleaned up before they are relayed to the other members of the room.
+type SignallingPolicy struct {
+	// StripPrivateCandidates drops the host candidates and hides the private addresses in the
+	// others, so the members don't learn each others local addresses.
+	StripPrivateCandidates bool
+
+	// Media is the media policy of every room type, the room types missing from it allow any media.
+	// DefaultMediaPolicies are used when it is nil.
+	Media map[RoomType]MediaPolicy
+}
+
+// WithSignallingPolicy makes the hub check the session descriptions and the ICE candidates with
+// the policy.
+func WithSignallingPolicy(policy SignallingPolicy) HubOption {
+	return func(h *Hub) {
+		if policy.Media == nil {
+			policy.Media = DefaultMediaPolicies
+		}
+
+		h.policy = policy
+	}
+}
+
+// mediaNotAllowed is the error for a session description which goes against the media policy.
+func mediaNotAllowed(message string) error {
+	return &ProtocolError{Code: CodeMediaNotAllowed, Message: message}
+}
+
+// sanitizeSDP checks the session description against the media policy of the room and removes the
+// candidates the other members must not see.
+func (p SignallingPolicy) sanitizeSDP(room *Room, desc *sdp.SessionDescription) error {
+	media, limited := p.Media[room.RoomType]
+	for _, m := range desc.Media {
+		if !limited || m.Rejected() {
+			continue
+		}
+
+		if !contains(media.Media, m.Kind) {
+			return mediaNotAllowed(fmt.Sprintf("%s media is not allowed in %s rooms", m.Kind, room.RoomType))
+		}
+
+		codecs, ok := media.Codecs[m.Kind]
+		if !ok || !m.IsRTP() {
+			continue
+		}
+
+		m.RemoveFormats(func(_, codec string) bool {
+			return contains(codecs, codec)
+		})
+
+		if len(m.Formats) == 0 {
+			return mediaNotAllowed(fmt.Sprintf("none of the %s codecs is allowed", m.Kind))
+		}
+	}
+
+	desc.FilterCandidates(func(c *sdp.Candidate) bool {
+		return p.allowCandidate(room, c)
+	})
+
+	if p.StripPrivateCandidates || room.RelayOnly {
+		desc.HidePrivateAddresses()
+	}
+
+	return nil
+}
+
+// screenShares returns how many members of a room of the room type may share their screen at the
+// same time.
+func (p SignallingPolicy) screenShares(roomType RoomType) int {
+	media, ok := p.Media[roomType]
+	if !ok {
+		return defaultScreenShares
+	}
+
+	return media.ScreenShares
+}
+
+// allowCandidate reports if the candidate may be relayed to the other members of the room, it
+// hides the addresses the candidate shouldn't give away.
+func (p SignallingPolicy) allowCandidate(room *Room, c *sdp.Candidate) bool {
+	if room.RelayOnly {
+		if c.Type != sdp.CandidateRelay {
+			metrics.CandidatesDropped.WithLabelValues("relay_only").Inc()
+			return false
+		}
+
+		// the related address of a relay candidate is the public address of the member.
+		c.RelatedAddress, c.RelatedPort = "0.0.0.0", 0
+		return true
+	}
+
+	if p.StripPrivateCandidates {
+		if c.IsPrivate() {
+			metrics.CandidatesDropped.WithLabelValues("private").Inc()
+			return false
+		}
+
+		c.HideRelatedAddress()
+	}
+
+	return true
+}
+
+// contains reports if the list has the value, ignoring the case.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
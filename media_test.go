@@ -0,0 +1,202 @@
+package talky
+
+import (
+	"github.com/iamsayantan/talky/sdp"
+	"strings"
+	"testing"
+)
+
+const audioVideoOffer = "v=0\r\n" +
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\n" +
+	"c=IN IP4 192.168.1.20\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=fmtp:111 minptime=10\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host\r\n" +
+	"a=candidate:2 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.20 rport 54321\r\n" +
+	"a=candidate:3 1 udp 41885439 198.51.100.9 3478 typ relay raddr 203.0.113.7 rport 54321\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 98\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=rtpmap:98 H264/90000\r\n" +
+	"a=fmtp:98 profile-level-id=42e01f\r\n"
+
+func TestSanitizeSDP(t *testing.T) {
+	policy := SignallingPolicy{Media: map[RoomType]MediaPolicy{
+		AudioRoom: {Media: []string{"audio"}, Codecs: map[string][]string{"audio": {"opus"}}},
+		AudioVideoRoom: {
+			Media:  []string{"audio", "video"},
+			Codecs: map[string][]string{"audio": {"opus"}, "video": {"vp8"}},
+		},
+	}}
+
+	tests := []struct {
+		name     string
+		roomType RoomType
+		sdp      string
+		wantErr  bool
+		contains []string
+		omits    []string
+	}{
+		{
+			name:     "disallowed codecs are removed",
+			roomType: AudioVideoRoom,
+			sdp:      audioVideoOffer,
+			contains: []string{"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n", "m=video 9 UDP/TLS/RTP/SAVPF 96\r\n", "a=rtpmap:96 VP8/90000"},
+			omits:    []string{"H264", "profile-level-id"},
+		},
+		{
+			name:     "video in an audio room",
+			roomType: AudioRoom,
+			sdp:      audioVideoOffer,
+			wantErr:  true,
+		},
+		{
+			name:     "rejected video in an audio room",
+			roomType: AudioRoom,
+			sdp:      strings.Replace(audioVideoOffer, "m=video 9 ", "m=video 0 ", 1),
+			contains: []string{"m=video 0 UDP/TLS/RTP/SAVPF 96 98\r\n"},
+		},
+		{
+			name:     "no allowed codec left",
+			roomType: AudioVideoRoom,
+			sdp:      strings.Replace(audioVideoOffer, "a=rtpmap:96 VP8/90000", "a=rtpmap:96 AV1/90000", 1),
+			wantErr:  true,
+		},
+		{
+			name:     "data channel in an audio room",
+			roomType: AudioRoom,
+			sdp:      audioVideoOffer[:strings.Index(audioVideoOffer, "m=video")] + "m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desc, err := sdp.Parse(tt.sdp)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+
+			err = policy.sanitizeSDP(NewRoom(tt.roomType, "room"), desc)
+			if tt.wantErr {
+				if errorCode(err) != CodeMediaNotAllowed {
+					t.Errorf("sanitizeSDP = %v, want %s", err, CodeMediaNotAllowed)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("sanitizeSDP: %v", err)
+			}
+
+			s := desc.String()
+			for _, want := range tt.contains {
+				if !strings.Contains(s, want) {
+					t.Errorf("sanitized description has no %q:\n%s", want, s)
+				}
+			}
+
+			for _, omit := range tt.omits {
+				if strings.Contains(s, omit) {
+					t.Errorf("sanitized description still has %q:\n%s", omit, s)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeSDPRelayOnly(t *testing.T) {
+	room := NewRoom(AudioVideoRoom, "room")
+	room.RelayOnly = true
+
+	desc, err := sdp.Parse(audioVideoOffer)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if err := (SignallingPolicy{Media: DefaultMediaPolicies}).sanitizeSDP(room, desc); err != nil {
+		t.Fatalf("sanitizeSDP: %v", err)
+	}
+
+	s := desc.String()
+	for _, omit := range []string{"typ host", "typ srflx", "192.168.1.20", "203.0.113.7"} {
+		if strings.Contains(s, omit) {
+			t.Errorf("relay only description still has %q:\n%s", omit, s)
+		}
+	}
+
+	if !strings.Contains(s, "198.51.100.9 3478 typ relay raddr 0.0.0.0 rport 0") {
+		t.Errorf("relay candidate is missing or gives away the related address:\n%s", s)
+	}
+}
+
+func TestAllowCandidate(t *testing.T) {
+	tests := []struct {
+		candidate   string
+		relayOnly   bool
+		stripHost   bool
+		allowed     bool
+		wantRelated string
+	}{
+		{"candidate:1 1 udp 1 192.168.1.20 5000 typ host", true, false, false, ""},
+		{"candidate:1 1 udp 1 203.0.113.7 5000 typ srflx raddr 192.168.1.20 rport 5000", true, false, false, ""},
+		{"candidate:1 1 udp 1 203.0.113.7 5000 typ prflx", true, false, false, ""},
+		{"candidate:1 1 tcp 1 198.51.100.9 443 typ relay raddr 203.0.113.7 rport 5000", true, false, true, "0.0.0.0"},
+		{"candidate:1 1 udp 1 192.168.1.20 5000 typ host", false, false, true, ""},
+		{"candidate:1 1 udp 1 192.168.1.20 5000 typ host", false, true, false, ""},
+		{"candidate:1 1 udp 1 abc.local 5000 typ host", false, true, false, ""},
+		{"candidate:1 1 udp 1 203.0.113.7 5000 typ srflx raddr 192.168.1.20 rport 5000", false, true, true, "0.0.0.0"},
+		{"candidate:1 1 udp 1 203.0.113.7 5000 typ srflx raddr 192.168.1.20 rport 5000", false, false, true, "192.168.1.20"},
+	}
+
+	for _, tt := range tests {
+		c, err := sdp.ParseCandidate(tt.candidate)
+		if err != nil {
+			t.Fatalf("ParseCandidate(%s): %v", tt.candidate, err)
+		}
+
+		room := NewRoom(AudioRoom, "room")
+		room.RelayOnly = tt.relayOnly
+		policy := SignallingPolicy{StripPrivateCandidates: tt.stripHost}
+
+		if got := policy.allowCandidate(room, c); got != tt.allowed {
+			t.Errorf("allowCandidate(%s), relay only %v, strip %v = %v, want %v", tt.candidate, tt.relayOnly, tt.stripHost, got, tt.allowed)
+			continue
+		}
+
+		if tt.allowed && c.RelatedAddress != tt.wantRelated {
+			t.Errorf("allowCandidate(%s) left the related address %q, want %q", tt.candidate, c.RelatedAddress, tt.wantRelated)
+		}
+	}
+}
+
+func TestSignallingMessageSize(t *testing.T) {
+	room := RoomMessage{RoomID: "room", TargetUserID: 2}
+	mid := "0"
+
+	tests := []struct {
+		name    string
+		payload interface{ Validate() error }
+		wantErr bool
+	}{
+		{"sdp at the limit", SDPMessage{RoomMessage: room, SDP: &SessionDescription{Type: "offer", SDP: strings.Repeat("x", maxSDPLength)}}, false},
+		{"oversized sdp", SDPMessage{RoomMessage: room, SDP: &SessionDescription{Type: "offer", SDP: strings.Repeat("x", maxSDPLength+1)}}, true},
+		{"candidate at the limit", ICEMessage{RoomMessage: room, Candidate: &ICECandidateInit{Candidate: strings.Repeat("x", maxCandidateLength), SDPMid: &mid}}, false},
+		{"oversized candidate", ICEMessage{RoomMessage: room, Candidate: &ICECandidateInit{Candidate: strings.Repeat("x", maxCandidateLength+1), SDPMid: &mid}}, true},
+		{"oversized room id", ICEMessage{RoomMessage: RoomMessage{RoomID: strings.Repeat("r", maxRoomIDLength+1), TargetUserID: 2}, Candidate: &ICECandidateInit{SDPMid: &mid}}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.payload.Validate()
+		if tt.wantErr && errorCode(err) != CodeInvalidPayload {
+			t.Errorf("%s: Validate = %v, want %s", tt.name, err, CodeInvalidPayload)
+		}
+
+		if !tt.wantErr && err != nil {
+			t.Errorf("%s: Validate = %v, want nil", tt.name, err)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package talky
 
-import "encoding/json"
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
 const (
 	CreateOrJoinRoom = "CREATE_OR_JOIN"
@@ -9,17 +15,47 @@ const (
 	ICECandidate     = "ICE_CANDIDATE"
 	RoomJoin         = "ROOM_JOIN"
 	Hangup           = "HANGUP"
+	RoomClosed       = "ROOM_CLOSED"
+	Kicked           = "KICKED"
+	Stats            = "STATS"
+	ServerShutdown   = "SERVER_SHUTDOWN"
+	Heartbeat        = "HEARTBEAT"
+	Ack              = "ACK"
+	KeyExchange      = "KEY_EXCHANGE"
+	KeyRotation      = "KEY_ROTATION"
+	ScreenShareStart = "SCREEN_SHARE_START"
+	ScreenShareStop  = "SCREEN_SHARE_STOP"
+	RoomState        = "ROOM_STATE"
+	Chat             = "CHAT"
+	HandRaise        = "HAND_RAISE"
+	MediaStateChange = "MEDIA_STATE"
+	MuteAll          = "MUTE_ALL"
+	AudioLevel       = "AUDIO_LEVEL"
+	ActiveSpeaker    = "ACTIVE_SPEAKER"
+	Error            = "error"
+)
+
+// The reasons the members of an end-to-end encrypted room are asked to rotate their media keys.
+const (
+	KeyRotationJoin  = "join"
+	KeyRotationLeave = "leave"
+	KeyRotationKick  = "kick"
 )
 
 // BroadcastMessage defines the type for broadcast message.
 type BroadcastMessage struct {
 	User    *User  // User from whom we got the message
 	Payload []byte // Payload the message
+
+	client *Client // client is the connection the message came from, errors are sent back to it.
 }
 
 // Message type represents the basic message type exchanged with clients.
-// Depending on the type, the payload structure can be different.
+// Depending on the type, the payload structure can be different. Every message carries an id,
+// which the server refers to when it acknowledges the message or reports its failure.
 type Message struct {
+	ID      string          `json:"id"`
+	Version int             `json:"v"`
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 }
@@ -28,6 +64,29 @@ type Message struct {
 type CreateOrJoinRoomMessage struct {
 	RoomID   string   `json:"room_id"`
 	RoomType RoomType `json:"room_type"`
+
+	// RelayOnly makes the members of a new room connect through the TURN servers only, so they
+	// never learn each others addresses. It is ignored when joining an existing room.
+	RelayOnly bool `json:"relay_only,omitempty"`
+
+	// E2EE makes a new room end-to-end encrypted, only the users with an identity key can join it
+	// and the calls can't be recorded. It is ignored when joining an existing room.
+	E2EE bool `json:"e2ee,omitempty"`
+
+	// MediaState is the media the user joins with turned off.
+	MediaState
+}
+
+func (m CreateOrJoinRoomMessage) Validate() error {
+	if err := validateRoomID(m.RoomID); err != nil {
+		return err
+	}
+
+	if m.RoomType != AudioRoom && m.RoomType != AudioVideoRoom {
+		return invalidPayload("room_type must be AUDIO or AUDIO_VIDEO")
+	}
+
+	return nil
 }
 
 // Hangup is the payload sent when an user leaves a call.
@@ -36,30 +95,381 @@ type HangupCall struct {
 	UserID uint   `json:"user_id"`
 }
 
+func (m HangupCall) Validate() error {
+	return validateRoomID(m.RoomID)
+}
+
 type RoomMessage struct {
 	RoomID       string `json:"room_id"`        // RoomID is id of the room for where the SDPMessage is intended.
 	User         User   `json:"user"`           // User is the user who sent the message.
 	TargetUserID uint   `json:"target_user_id"` // TargetUserID holds the id of the user if the message is sent specifically to this user.
 }
 
+func (m RoomMessage) Validate() error {
+	if err := validateRoomID(m.RoomID); err != nil {
+		return err
+	}
+
+	if m.TargetUserID == 0 {
+		return invalidPayload("target_user_id is required")
+	}
+
+	return nil
+}
+
+// SessionDescription is the session description of a peer connection, the way the browsers
+// serialize RTCSessionDescription.
+type SessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
 // SDPMessage is the payload for session descriptions in a room.
 type SDPMessage struct {
 	RoomMessage
-	SDP interface{} `json:"sdp"` // SDP is the actual SDP payload.
+	SDP *SessionDescription `json:"sdp"` // SDP is the actual SDP payload.
+}
+
+func (m SDPMessage) Validate() error {
+	if err := m.RoomMessage.Validate(); err != nil {
+		return err
+	}
+
+	if m.SDP == nil || m.SDP.SDP == "" {
+		return invalidPayload("sdp is required")
+	}
+
+	if m.SDP.Type != "offer" && m.SDP.Type != "answer" && m.SDP.Type != "pranswer" {
+		return invalidPayload("sdp type must be offer, answer or pranswer")
+	}
+
+	if len(m.SDP.SDP) > maxSDPLength {
+		return invalidPayload("sdp is too long")
+	}
+
+	return nil
+}
+
+// ICECandidateInit is an ICE candidate of a peer connection, the way the browsers serialize
+// RTCIceCandidate. An empty candidate tells the peer there are no more candidates.
+type ICECandidateInit struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
 }
 
 type ICEMessage struct {
 	RoomMessage
-	Candidate interface{} `json:"candidate"`
+	Candidate *ICECandidateInit `json:"candidate"`
+}
+
+func (m ICEMessage) Validate() error {
+	if err := m.RoomMessage.Validate(); err != nil {
+		return err
+	}
+
+	if m.Candidate == nil {
+		return invalidPayload("candidate is required")
+	}
+
+	if len(m.Candidate.Candidate) > maxCandidateLength {
+		return invalidPayload("candidate is too long")
+	}
+
+	if m.Candidate.SDPMid == nil && m.Candidate.SDPMLineIndex == nil {
+		return invalidPayload("candidate needs an sdpMid or an sdpMLineIndex")
+	}
+
+	return nil
+}
+
+func validateRoomID(roomID string) error {
+	if roomID == "" {
+		return invalidPayload("room_id is required")
+	}
+
+	if len(roomID) > maxRoomIDLength {
+		return invalidPayload("room_id is too long")
+	}
+
+	return nil
 }
 
 type ResponseMessage struct {
+	Version int         `json:"v"`
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload"`
+
+	// lossy messages may be dropped when the client can't keep up, whatever their type.
+	lossy bool
+}
+
+// AckMessage tells the client its message was handled.
+type AckMessage struct {
+	RequestID string `json:"request_id"`
+}
+
+// ErrorMessage tells the client why its message failed. RequestID is empty when the message was
+// too broken to read its id.
+type ErrorMessage struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
 }
 
 type RoomJoined struct {
 	RoomID      string `json:"room_id"`
 	User        User   `json:"user"`
 	IsInitiator bool   `json:"is_initiator"`
+	IsGuest     bool   `json:"is_guest"`
+	RelayOnly   bool   `json:"relay_only"` // RelayOnly tells the members to only gather relay candidates.
+	E2EE        bool   `json:"e2ee"`
+	KeyEpoch    uint64 `json:"key_epoch,omitempty"`    // KeyEpoch is the current key epoch of an end-to-end encrypted room.
+	IdentityKey string `json:"identity_key,omitempty"` // IdentityKey is the fingerprint of the identity key of the user who joined.
+
+	// ScreenShares are the screens being shared in the room, so the members joining late know
+	// which of the streams they receive are screens.
+	ScreenShares []ScreenShare `json:"screen_shares,omitempty"`
+}
+
+// RoomClosedMessage is sent to all members of a room when a moderator closes it.
+type RoomClosedMessage struct {
+	RoomID string `json:"room_id"`
+}
+
+// KickedMessage is sent to a member who was removed from the room by a moderator.
+type KickedMessage struct {
+	RoomID string `json:"room_id"`
+}
+
+// ServerShutdownMessage is sent to every client when the server is going down, the clients should
+// reconnect and join their room again. The server closes the connection after the drain period.
+type ServerShutdownMessage struct {
+	Message   string `json:"message"`
+	Reconnect bool   `json:"reconnect"`
+}
+
+// KeyExchangeMessage carries the media key of a member of an end-to-end encrypted room, encrypted
+// for a single other member. The server relays it without being able to read it.
+type KeyExchangeMessage struct {
+	RoomMessage
+	Epoch uint64 `json:"epoch"` // Epoch is the key epoch of the room the key was made for.
+	Key   string `json:"key"`   // Key is the base64 encoded encrypted media key.
+}
+
+func (m KeyExchangeMessage) Validate() error {
+	if err := m.RoomMessage.Validate(); err != nil {
+		return err
+	}
+
+	if m.Epoch == 0 {
+		return invalidPayload("epoch is required")
+	}
+
+	if m.Key == "" {
+		return invalidPayload("key is required")
+	}
+
+	if len(m.Key) > maxWrappedKeyLength {
+		return invalidPayload("key is too long")
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(m.Key); err != nil {
+		return invalidPayload("key must be base64 encoded")
+	}
+
+	return nil
+}
+
+// KeyRotationMessage is sent to the members of an end-to-end encrypted room when someone joined or
+// left it. Every member then makes a new media key and sends it to the others for the new epoch,
+// so the members who left can't follow the call and the new ones can't decrypt what they missed.
+type KeyRotationMessage struct {
+	RoomID  string `json:"room_id"`
+	Epoch   uint64 `json:"epoch"`
+	Reason  string `json:"reason"`  // Reason is join, leave or kick.
+	UserID  uint   `json:"user_id"` // UserID is the user who joined or left.
+	Members []uint `json:"members"` // Members are the members the new key has to be sent to.
+}
+
+// ScreenShare is a screen shared by a member of a room. The screen is sent as its own media stream
+// over the peer connections of the member, StreamID is the id of that stream.
+type ScreenShare struct {
+	UserID   uint   `json:"user_id"`
+	StreamID string `json:"stream_id"`
+}
+
+// ScreenShareStartMessage is sent by a member who starts sharing their screen. The other members
+// get it with UserID set to the member.
+type ScreenShareStartMessage struct {
+	RoomID   string `json:"room_id"`
+	UserID   uint   `json:"user_id"`
+	StreamID string `json:"stream_id"`
+}
+
+func (m ScreenShareStartMessage) Validate() error {
+	if err := validateRoomID(m.RoomID); err != nil {
+		return err
+	}
+
+	if m.StreamID == "" {
+		return invalidPayload("stream_id is required")
+	}
+
+	if len(m.StreamID) > maxStreamIDLength {
+		return invalidPayload("stream_id is too long")
+	}
+
+	return nil
+}
+
+// ScreenShareStopMessage stops the screen share of a member, the sender's own when UserID is zero.
+// Only the host of the room and the moderators may stop the screen shares of the others. Every
+// member gets it with StoppedBy set, the member whose share was stopped too.
+type ScreenShareStopMessage struct {
+	RoomID    string `json:"room_id"`
+	UserID    uint   `json:"user_id"`
+	StoppedBy uint   `json:"stopped_by"`
+}
+
+func (m ScreenShareStopMessage) Validate() error {
+	return validateRoomID(m.RoomID)
+}
+
+// RoomStateMessage is the state of a room, sent to the members joining it. The changes after it are
+// sent as they happen, like ROOM_JOIN, HANGUP, SCREEN_SHARE_START or HAND_RAISE.
+type RoomStateMessage struct {
+	RoomID   string        `json:"room_id"`
+	Settings RoomSettings  `json:"settings"`
+	Members  []MemberState `json:"members"` // Members are in the order they joined, the new member included.
+	Chat     []ChatMessage `json:"chat"`    // Chat are the latest chat messages, the oldest first.
+	KeyEpoch uint64        `json:"key_epoch,omitempty"`
+
+	// ActiveSpeaker is the dominant speaker of the room, zero before anyone spoke.
+	ActiveSpeaker uint `json:"active_speaker,omitempty"`
+}
+
+// ChatMessage is a text message sent to everyone in a room. The members get it with the sender and
+// the time set by the server.
+type ChatMessage struct {
+	RoomID string    `json:"room_id"`
+	User   User      `json:"user"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+func (m ChatMessage) Validate() error {
+	if err := validateRoomID(m.RoomID); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(m.Text) == "" {
+		return invalidPayload("text is required")
+	}
+
+	if !utf8.ValidString(m.Text) {
+		return invalidPayload("text must be utf-8")
+	}
+
+	if utf8.RuneCountInString(m.Text) > maxChatLength {
+		return invalidPayload("text is too long")
+	}
+
+	return nil
+}
+
+// HandRaiseMessage raises or lowers the hand of a member, the sender's own when UserID is zero. Only
+// the host of the room and the moderators may lower the hands of the others. Every member gets it
+// with ChangedBy set.
+type HandRaiseMessage struct {
+	RoomID    string `json:"room_id"`
+	UserID    uint   `json:"user_id"`
+	Raised    bool   `json:"raised"`
+	ChangedBy uint   `json:"changed_by"`
+}
+
+func (m HandRaiseMessage) Validate() error {
+	return validateRoomID(m.RoomID)
+}
+
+// MediaStateMessage changes the media state of a member, the sender's own when UserID is zero. Only
+// the given fields are changed. The host of the room and the moderators may mute the others, but
+// not unmute them. Every member gets it with all the fields and ChangedBy set.
+type MediaStateMessage struct {
+	RoomID     string `json:"room_id"`
+	UserID     uint   `json:"user_id"`
+	AudioMuted *bool  `json:"audio_muted"`
+	VideoMuted *bool  `json:"video_muted"`
+	ChangedBy  uint   `json:"changed_by"`
+}
+
+func (m MediaStateMessage) Validate() error {
+	if err := validateRoomID(m.RoomID); err != nil {
+		return err
+	}
+
+	if m.AudioMuted == nil && m.VideoMuted == nil {
+		return invalidPayload("audio_muted or video_muted is required")
+	}
+
+	return nil
+}
+
+// MuteAllMessage mutes the audio, the video or both of every member of the room but the sender, who
+// has to be the host of the room or a moderator. The members get a MEDIA_STATE for each change.
+type MuteAllMessage struct {
+	RoomID string `json:"room_id"`
+	Audio  bool   `json:"audio"`
+	Video  bool   `json:"video"`
+}
+
+func (m MuteAllMessage) Validate() error {
+	if err := validateRoomID(m.RoomID); err != nil {
+		return err
+	}
+
+	if !m.Audio && !m.Video {
+		return invalidPayload("audio or video is required")
+	}
+
+	return nil
+}
+
+// AudioLevelMessage is a sample of the audio level of the microphone of a member, sent a few times a
+// second while they are in a call. The server doesn't receive the media, so the dominant speaker is
+// picked from what the clients report.
+type AudioLevelMessage struct {
+	RoomID string  `json:"room_id"`
+	Level  float64 `json:"level"` // Level is between 0 and 1, like the audioLevel of the WebRTC statistics.
+}
+
+func (m AudioLevelMessage) Validate() error {
+	if err := validateRoomID(m.RoomID); err != nil {
+		return err
+	}
+
+	if !(m.Level >= 0 && m.Level <= 1) {
+		return invalidPayload("level must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// ActiveSpeakerMessage is sent to the members of a room when the dominant speaker changed.
+type ActiveSpeakerMessage struct {
+	RoomID string `json:"room_id"`
+	UserID uint   `json:"user_id"`
+}
+
+// StatsReport is the summary of the WebRTC statistics of one peer connection, which the clients
+// send periodically while they are in a call.
+type StatsReport struct {
+	RoomID        string  `json:"room_id"`
+	PeerUserID    uint    `json:"peer_user_id"`   // PeerUserID is the user at the other end of the connection.
+	RTT           float64 `json:"rtt"`            // RTT is the round trip time in milliseconds.
+	Jitter        float64 `json:"jitter"`         // Jitter of the received packets in milliseconds.
+	PacketLoss    float64 `json:"packet_loss"`    // PacketLoss is the percentage of the packets lost since the last report.
+	Bitrate       float64 `json:"bitrate"`        // Bitrate of the received media in kbps.
+	CandidateType string  `json:"candidate_type"` // CandidateType of the selected local candidate: host, srflx, prflx or relay.
 }
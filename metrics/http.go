@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"github.com/go-chi/chi"
+	chiware "github.com/go-chi/chi/middleware"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Middleware records the count and the latency of the http requests by chi route pattern, which
+// keeps the number of series bounded no matter which urls are requested. Websocket upgrades are
+// skipped, their duration is the lifetime of the connection.
+func Middleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		ww := chiware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		HTTPDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+
+	return http.HandlerFunc(fn)
+}
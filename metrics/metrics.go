@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const namespace = "talky"
+
+// hubSnapshotTimeout is how long a scrape waits for the state of the hub. A hub which doesn't
+// answer in time leaves its gauges out of the scrape instead of hanging it.
+const hubSnapshotTimeout = 2 * time.Second
+
+// Registry holds all the metrics of talky, along with the go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HubMessages counts the websocket messages processed by the hub, by message type.
+	HubMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hub_messages_total",
+		Help:      "Websocket messages processed by the hub, by message type.",
+	}, []string{"type"})
+
+	// HubErrors counts the error responses the hub sent back to the clients, by the message type
+	// which failed.
+	HubErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "hub_errors_total",
+		Help:      "Error responses sent to the websocket clients, by the type of the failed message.",
+	}, []string{"type"})
+
+	// SendDropped counts the droppable messages which were dropped to make room in the full send
+	// queue of a client, by message type.
+	SendDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "send_dropped_total",
+		Help:      "Messages dropped because the send queue of the client was full, by message type.",
+	}, []string{"type"})
+
+	// SlowConsumerDisconnects counts the clients which were disconnected because they couldn't keep
+	// up with the critical messages.
+	SlowConsumerDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumer_disconnects_total",
+		Help:      "Clients disconnected because their send queue was full of critical messages.",
+	})
+
+	// RateLimited counts the websocket messages rejected for going over the rate limits, by message
+	// type.
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_messages_total",
+		Help:      "Websocket messages rejected by the rate limits, by message type.",
+	}, []string{"type"})
+
+	// RateLimitDisconnects counts the clients disconnected for going over the rate limits again
+	// and again.
+	RateLimitDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_disconnects_total",
+		Help:      "Clients disconnected for repeatedly going over the rate limits.",
+	})
+
+	// CandidatesDropped counts the ICE candidates which were not relayed to the other members of the
+	// room, by the reason, which is either private or relay_only.
+	CandidatesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ice_candidates_dropped_total",
+		Help:      "ICE candidates not relayed to the other members of the room, by reason.",
+	}, []string{"reason"})
+
+	// UpgradeFailures counts the websocket connections which failed to upgrade.
+	UpgradeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_upgrade_failures_total",
+		Help:      "Websocket upgrades which failed.",
+	})
+
+	// Logins counts the login attempts by result, which is either success or failure.
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by result.",
+	}, []string{"result"})
+
+	// HTTPRequests counts the http requests by route, method and status code.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	// HTTPDuration observes the latency of the http requests by route and method.
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		HubMessages,
+		HubErrors,
+		SendDropped,
+		SlowConsumerDisconnects,
+		RateLimited,
+		RateLimitDisconnects,
+		CandidatesDropped,
+		UpgradeFailures,
+		Logins,
+		HTTPRequests,
+		HTTPDuration,
+		hubStats,
+	)
+}
+
+// Handler serves the metrics in the prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// HubSnapshot is the state of the hub at the time of a scrape.
+type HubSnapshot struct {
+	ConnectedClients int
+	RoomsByType      map[string]int
+	RoomMembers      int
+	QueuedMessages   int
+}
+
+// hubCollector reads the gauges of the hub when the metrics are scraped, so the hub doesn't have to
+// keep them up to date.
+type hubCollector struct {
+	mu       sync.RWMutex
+	snapshot func(ctx context.Context) (HubSnapshot, error)
+	timeout  time.Duration
+
+	clients *prometheus.Desc
+	rooms   *prometheus.Desc
+	members *prometheus.Desc
+	queued  *prometheus.Desc
+}
+
+var hubStats = &hubCollector{
+	timeout: hubSnapshotTimeout,
+	clients: prometheus.NewDesc(namespace+"_connected_clients", "Connected websocket clients.", nil, nil),
+	rooms:   prometheus.NewDesc(namespace+"_active_rooms", "Active rooms by room type.", []string{"room_type"}, nil),
+	members: prometheus.NewDesc(namespace+"_room_members", "Members in all the active rooms.", nil, nil),
+	queued:  prometheus.NewDesc(namespace+"_send_queue_messages", "Messages waiting in the send queues of the clients.", nil, nil),
+}
+
+// SetHubSnapshot sets the function which reads the state of the hub. It should give up once the
+// context is done.
+func SetHubSnapshot(snapshot func(ctx context.Context) (HubSnapshot, error)) {
+	hubStats.mu.Lock()
+	hubStats.snapshot = snapshot
+	hubStats.mu.Unlock()
+}
+
+func (c *hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.clients
+	ch <- c.rooms
+	ch <- c.members
+	ch <- c.queued
+}
+
+func (c *hubCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	snapshot := c.snapshot
+	c.mu.RUnlock()
+
+	if snapshot == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	s, err := snapshot(ctx)
+	if err != nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.clients, prometheus.GaugeValue, float64(s.ConnectedClients))
+	ch <- prometheus.MustNewConstMetric(c.members, prometheus.GaugeValue, float64(s.RoomMembers))
+	ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(s.QueuedMessages))
+	for roomType, count := range s.RoomsByType {
+		ch <- prometheus.MustNewConstMetric(c.rooms, prometheus.GaugeValue, float64(count), roomType)
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+	"time"
+)
+
+// collect returns the metrics the collector sends for a scrape.
+func collect(c prometheus.Collector) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+
+	return metrics
+}
+
+func TestHubCollector(t *testing.T) {
+	c := &hubCollector{timeout: time.Second, clients: hubStats.clients, rooms: hubStats.rooms, members: hubStats.members, queued: hubStats.queued}
+	c.snapshot = func(ctx context.Context) (HubSnapshot, error) {
+		return HubSnapshot{ConnectedClients: 3, RoomsByType: map[string]int{"AUDIO": 1, "AUDIO_VIDEO": 0}}, nil
+	}
+
+	if got := len(collect(c)); got != 5 {
+		t.Errorf("collected %d metrics, want 5", got)
+	}
+}
+
+func TestHubCollectorStalledHub(t *testing.T) {
+	c := &hubCollector{timeout: 50 * time.Millisecond, clients: hubStats.clients, rooms: hubStats.rooms, members: hubStats.members, queued: hubStats.queued}
+	c.snapshot = func(ctx context.Context) (HubSnapshot, error) {
+		<-ctx.Done()
+		return HubSnapshot{}, ctx.Err()
+	}
+
+	done := make(chan []prometheus.Metric, 1)
+	go func() {
+		done <- collect(c)
+	}()
+
+	select {
+	case metrics := <-done:
+		if len(metrics) != 0 {
+			t.Errorf("collected %d metrics from a stalled hub, want none", len(metrics))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape hangs on a stalled hub")
+	}
+}
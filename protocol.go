@@ -0,0 +1,164 @@
+package talky
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ProtocolVersion is the version of the signalling protocol spoken by the server. Clients may leave
+// the version out of their messages, they are then taken to speak this one.
+const ProtocolVersion = 1
+
+const (
+	// maxRoomIDLength is the longest room id accepted, it has to fit the call records.
+	maxRoomIDLength = 64
+
+	// maxSDPLength is the longest session description accepted.
+	maxSDPLength = 64 * 1024
+
+	// maxCandidateLength is the longest ICE candidate accepted.
+	maxCandidateLength = 1024
+
+	// maxWrappedKeyLength is the longest encrypted media key accepted.
+	maxWrappedKeyLength = 4096
+
+	// maxStreamIDLength is the longest media stream id accepted, the msid limit of RFC 8830.
+	maxStreamIDLength = 64
+
+	// maxChatLength is the most characters a chat message may have.
+	maxChatLength = 2000
+)
+
+// ErrorCode tells the clients what went wrong with their message without them having to match the
+// error messages.
+type ErrorCode string
+
+const (
+	CodeMalformedMessage   ErrorCode = "malformed_message"
+	CodeUnsupportedVersion ErrorCode = "unsupported_version"
+	CodeMissingRequestID   ErrorCode = "missing_request_id"
+	CodeUnknownType        ErrorCode = "unknown_type"
+	CodeInvalidPayload     ErrorCode = "invalid_payload"
+	CodeForbidden          ErrorCode = "forbidden"
+	CodeRoomNotFound       ErrorCode = "room_not_found"
+	CodeRoomFull           ErrorCode = "room_full"
+	CodeAlreadyInRoom      ErrorCode = "already_in_room"
+	CodeNotRoomMember      ErrorCode = "not_room_member"
+	CodeRateLimited        ErrorCode = "rate_limited"
+	CodeMediaNotAllowed    ErrorCode = "media_not_allowed"
+	CodeStaleKeyEpoch      ErrorCode = "stale_key_epoch"
+	CodeScreenShareLimit   ErrorCode = "screen_share_limit"
+	CodeNotSharingScreen   ErrorCode = "not_sharing_screen"
+	CodeConnectionReplaced ErrorCode = "connection_replaced"
+	CodeInternal           ErrorCode = "internal_error"
+)
+
+// ProtocolError is an error which carries the code sent to the client.
+type ProtocolError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrMalformedMessage   = &ProtocolError{Code: CodeMalformedMessage, Message: "message could not be decoded"}
+	ErrUnsupportedVersion = &ProtocolError{Code: CodeUnsupportedVersion, Message: "protocol version is not supported"}
+	ErrMissingRequestID   = &ProtocolError{Code: CodeMissingRequestID, Message: "message has no id"}
+	ErrUnknownType        = &ProtocolError{Code: CodeUnknownType, Message: "unknown message type"}
+
+	// ErrConnectionReplaced is sent to a connection of the user when they connect again, it is closed
+	// right after.
+	ErrConnectionReplaced = &ProtocolError{Code: CodeConnectionReplaced, Message: "replaced by a newer connection"}
+	ErrInAnotherRoom      = errors.New("you are already a part of a room")
+)
+
+// errorCodes are the codes of the errors returned by the hub and the rooms.
+var errorCodes = map[error]ErrorCode{
+	ErrMissingScope:     CodeForbidden,
+	ErrGuestRoom:        CodeForbidden,
+	ErrRoomNotFound:     CodeRoomNotFound,
+	ErrRoomCapacityFull: CodeRoomFull,
+	ErrAlreadyInRoom:    CodeAlreadyInRoom,
+	ErrInAnotherRoom:    CodeAlreadyInRoom,
+	ErrNotRoomMember:    CodeNotRoomMember,
+	ErrInvalidStats:     CodeInvalidPayload,
+
+	ErrIdentityKeyRequired: CodeForbidden,
+	ErrRecordingNotAllowed: CodeForbidden,
+	ErrNotEncryptedRoom:    CodeForbidden,
+	ErrStaleKeyEpoch:       CodeStaleKeyEpoch,
+
+	ErrScreenShareNotAllowed: CodeForbidden,
+	ErrTooManyScreenShares:   CodeScreenShareLimit,
+	ErrNotSharingScreen:      CodeNotSharingScreen,
+	ErrNotHost:               CodeForbidden,
+}
+
+// errorCode returns the code the client gets for the error, errors nobody expected are internal.
+func errorCode(err error) ErrorCode {
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) {
+		return protocolErr.Code
+	}
+
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+
+	return CodeInternal
+}
+
+// invalidPayload is the error for a payload which failed the validation.
+func invalidPayload(message string) error {
+	return &ProtocolError{Code: CodeInvalidPayload, Message: message}
+}
+
+// decodeMessage parses the envelope of a message sent by a client.
+func decodeMessage(data []byte) (*Message, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, ErrMalformedMessage
+	}
+
+	if msg.Version != 0 && msg.Version != ProtocolVersion {
+		return &msg, ErrUnsupportedVersion
+	}
+
+	if msg.ID == "" {
+		return &msg, ErrMissingRequestID
+	}
+
+	return &msg, nil
+}
+
+// payloadValidator is a payload which can check itself once it is decoded.
+type payloadValidator interface {
+	Validate() error
+}
+
+// decodePayload decodes the payload of the message into v and validates it, so the handlers only
+// ever see valid payloads.
+func decodePayload(msg *Message, v interface{}) error {
+	if err := json.Unmarshal(msg.Payload, v); err != nil {
+		return invalidPayload("payload does not match the message type")
+	}
+
+	if validator, ok := v.(payloadValidator); ok {
+		return validator.Validate()
+	}
+
+	return nil
+}
+
+// newResponse builds the message of the given type for the clients, each client encodes it in its
+// own wire format.
+func newResponse(msgType string, payload interface{}) *ResponseMessage {
+	return &ResponseMessage{
+		Version: ProtocolVersion,
+		Type:    msgType,
+		Payload: payload,
+	}
+}
@@ -0,0 +1,106 @@
+package talky
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The averages above which a participant is considered to have had a poor call.
+const (
+	PoorRTT        = 300.0 // PoorRTT is the round trip time in milliseconds.
+	PoorJitter     = 30.0  // PoorJitter is the jitter in milliseconds.
+	PoorPacketLoss = 5.0   // PoorPacketLoss is the percentage of lost packets.
+)
+
+var ErrInvalidStats = errors.New("invalid stats report")
+
+var validCandidateTypes = map[string]bool{
+	"":      true,
+	"host":  true,
+	"srflx": true,
+	"prflx": true,
+	"relay": true,
+}
+
+// Validate checks the values of the report are in range.
+func (s StatsReport) Validate() error {
+	if err := validateRoomID(s.RoomID); err != nil {
+		return err
+	}
+
+	if s.RTT < 0 || s.Jitter < 0 || s.Bitrate < 0 || s.PacketLoss < 0 || s.PacketLoss > 100 {
+		return ErrInvalidStats
+	}
+
+	if !validCandidateTypes[s.CandidateType] {
+		return ErrInvalidStats
+	}
+
+	return nil
+}
+
+// CallQuality is the aggregate of the stats reports one participant sent during a call.
+type CallQuality struct {
+	ID            uint    `gorm:"primary_key" json:"-"`
+	CallID        uint    `gorm:"index" json:"-"`
+	UserID        uint    `gorm:"type:bigint" json:"user_id"`
+	Samples       int     `json:"samples"`
+	AvgRTT        float64 `json:"avg_rtt"`
+	MaxRTT        float64 `json:"max_rtt"`
+	AvgJitter     float64 `json:"avg_jitter"`
+	MaxJitter     float64 `json:"max_jitter"`
+	AvgPacketLoss float64 `json:"avg_packet_loss"`
+	MaxPacketLoss float64 `json:"max_packet_loss"`
+	AvgBitrate    float64 `json:"avg_bitrate"`
+	CandidateType string  `gorm:"type:varchar(8)" json:"candidate_type"` // CandidateType is the last reported one.
+}
+
+// add folds the report into the aggregate, the averages are kept as running means.
+func (q *CallQuality) add(report StatsReport) {
+	q.Samples++
+	n := float64(q.Samples)
+
+	q.AvgRTT += (report.RTT - q.AvgRTT) / n
+	q.AvgJitter += (report.Jitter - q.AvgJitter) / n
+	q.AvgPacketLoss += (report.PacketLoss - q.AvgPacketLoss) / n
+	q.AvgBitrate += (report.Bitrate - q.AvgBitrate) / n
+
+	if report.RTT > q.MaxRTT {
+		q.MaxRTT = report.RTT
+	}
+
+	if report.Jitter > q.MaxJitter {
+		q.MaxJitter = report.Jitter
+	}
+
+	if report.PacketLoss > q.MaxPacketLoss {
+		q.MaxPacketLoss = report.PacketLoss
+	}
+
+	if report.CandidateType != "" {
+		q.CandidateType = report.CandidateType
+	}
+}
+
+// Issues describes why the quality was poor, it is empty for a good call.
+func (q *CallQuality) Issues() []string {
+	issues := []string{}
+	if q.AvgRTT > PoorRTT {
+		issues = append(issues, fmt.Sprintf("high round trip time of %.0fms", q.AvgRTT))
+	}
+
+	if q.AvgJitter > PoorJitter {
+		issues = append(issues, fmt.Sprintf("high jitter of %.0fms", q.AvgJitter))
+	}
+
+	if q.AvgPacketLoss > PoorPacketLoss {
+		issues = append(issues, fmt.Sprintf("packet loss of %.1f%%", q.AvgPacketLoss))
+	}
+
+	return issues
+}
+
+// IsPoor reports if the quality was below the thresholds.
+func (q *CallQuality) IsPoor() bool {
+	return len(q.Issues()) > 0
+}
@@ -0,0 +1,195 @@
+package talky
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	errQueueFull   = errors.New("send queue is full")
+	errQueueClosed = errors.New("send queue is closed")
+)
+
+// sendPolicy decides what happens to the queued messages of a type when the client can't keep up.
+type sendPolicy int
+
+const (
+	// sendCritical messages are never dropped, missing one breaks the call or leaves the client
+	// waiting. A client whose queue is full of them is disconnected and joins again from scratch.
+	sendCritical sendPolicy = iota
+
+	// sendDroppable messages are dropped, the oldest first, to make room in a full queue.
+	sendDroppable
+
+	// sendLatest messages tell the state of something, like the media of a member, and only the
+	// latest one matters. A new one replaces the queued one about the same subject, so there are
+	// never many of them waiting and they are not dropped.
+	sendLatest
+)
+
+// sendPolicies are the send policies of the message types which are not critical, the types left
+// out are. The errors and the chat messages may be missed, the chat history comes with the room
+// state when the client joins again. Only the latest active speaker, media state and raised hand
+// matter. The acknowledgements of the telemetry are droppable too, see lossyRequests.
+var sendPolicies = map[string]sendPolicy{
+	Error:            sendDroppable,
+	Chat:             sendDroppable,
+	ActiveSpeaker:    sendLatest,
+	MediaStateChange: sendLatest,
+	HandRaise:        sendLatest,
+}
+
+// lossyRequests are the message types the clients keep sending whatever happens to the previous
+// ones, the acknowledgements of these may be dropped.
+var lossyRequests = map[string]bool{
+	Heartbeat:  true,
+	Stats:      true,
+	AudioLevel: true,
+}
+
+// stateMessage is the payload of a sendLatest message, the subject tells which state it is about.
+type stateMessage interface {
+	subject() string
+}
+
+func (m ActiveSpeakerMessage) subject() string {
+	return m.RoomID
+}
+
+func (m MediaStateMessage) subject() string {
+	return fmt.Sprintf("%s/%d", m.RoomID, m.UserID)
+}
+
+func (m HandRaiseMessage) subject() string {
+	return fmt.Sprintf("%s/%d", m.RoomID, m.UserID)
+}
+
+// policyOf returns the send policy of the message.
+func policyOf(message *ResponseMessage) sendPolicy {
+	if message.lossy {
+		return sendDroppable
+	}
+
+	return sendPolicies[message.Type]
+}
+
+// supersedes reports if the message makes the queued one worthless.
+func supersedes(message, queued *ResponseMessage) bool {
+	if message.Type != queued.Type || policyOf(message) != sendLatest {
+		return false
+	}
+
+	state, ok := message.Payload.(stateMessage)
+	if !ok {
+		return false
+	}
+
+	queuedState, ok := queued.Payload.(stateMessage)
+	return ok && state.subject() == queuedState.subject()
+}
+
+// sendQueue is the bounded queue of messages waiting to be written to a client. Pushing never
+// blocks, so a slow client can't hold up the hub.
+type sendQueue struct {
+	mu       sync.Mutex
+	messages []*ResponseMessage
+	max      int
+	closed   bool
+
+	// ready gets a signal whenever there is something for the write pump to do.
+	ready chan struct{}
+}
+
+func newSendQueue(max int) *sendQueue {
+	return &sendQueue{
+		max:   max,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push adds the message to the queue, in place of a queued state it supersedes. When the queue is
+// full the oldest droppable message makes room for it and the type of the dropped message is
+// returned. It fails with errQueueFull when none of the queued messages can be dropped.
+func (q *sendQueue) push(message *ResponseMessage) (dropped string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return "", errQueueClosed
+	}
+
+	for i, queued := range q.messages {
+		if supersedes(message, queued) {
+			q.remove(i)
+			break
+		}
+	}
+
+	if len(q.messages) >= q.max {
+		i := 0
+		for i < len(q.messages) && policyOf(q.messages[i]) != sendDroppable {
+			i++
+		}
+
+		if i == len(q.messages) {
+			return "", errQueueFull
+		}
+
+		dropped = q.messages[i].Type
+		q.remove(i)
+	}
+
+	q.messages = append(q.messages, message)
+	q.signal()
+	return dropped, nil
+}
+
+// pop takes all the queued messages. closed is true once the queue was closed, the returned
+// messages are then the last ones.
+func (q *sendQueue) pop() (messages []*ResponseMessage, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages, q.messages = q.messages, nil
+	return messages, q.closed
+}
+
+// close stops accepting messages, the ones already queued are still written. It can be called
+// more than once.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.signal()
+}
+
+// abort closes the queue throwing away the messages which were not written yet.
+func (q *sendQueue) abort() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.messages = nil
+	q.closed = true
+	q.signal()
+}
+
+// remove takes the i-th message out of the queue.
+func (q *sendQueue) remove(i int) {
+	q.messages = append(q.messages[:i], q.messages[i+1:]...)
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.messages)
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
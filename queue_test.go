@@ -0,0 +1,132 @@
+package talky
+
+import "testing"
+
+func fillQueue(t *testing.T, q *sendQueue, msgType string, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := q.push(newResponse(msgType, nil)); err != nil {
+			t.Fatalf("push %s: %v", msgType, err)
+		}
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	tests := []struct {
+		name        string
+		queued      []string
+		push        *ResponseMessage
+		wantDropped string
+		wantErr     error
+	}{
+		{"critical only", []string{Offer, ICECandidate, RoomJoin}, newResponse(Answer, nil), "", errQueueFull},
+		{"drops the oldest droppable", []string{Offer, Chat, Error}, newResponse(Answer, nil), Chat, nil},
+		{"drops an error", []string{Offer, Error, ICECandidate}, newResponse(Answer, nil), Error, nil},
+		{"latest states are kept", []string{MediaStateChange, HandRaise, ActiveSpeaker}, newResponse(Offer, nil), "", errQueueFull},
+		{"drops a lossy ack", []string{Offer, Ack, Ack}, newResponse(Answer, nil), Ack, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue(len(tt.queued))
+			for i, msgType := range tt.queued {
+				msg := newResponse(msgType, nil)
+				// only the second ack of the lossy case is the reply to telemetry.
+				msg.lossy = msgType == Ack && i == 1
+				if _, err := q.push(msg); err != nil {
+					t.Fatalf("push %s: %v", msgType, err)
+				}
+			}
+
+			dropped, err := q.push(tt.push)
+			if dropped != tt.wantDropped || err != tt.wantErr {
+				t.Errorf("push = %q, %v, want %q, %v", dropped, err, tt.wantDropped, tt.wantErr)
+			}
+
+			want := len(tt.queued)
+			if err != nil && q.len() != want {
+				t.Errorf("queue has %d messages after a failed push, want %d", q.len(), want)
+			}
+		})
+	}
+}
+
+func TestSendQueueLatestState(t *testing.T) {
+	q := newSendQueue(10)
+	muted, unmuted := true, false
+
+	pushes := []*ResponseMessage{
+		newResponse(MediaStateChange, MediaStateMessage{RoomID: "r", UserID: 1, AudioMuted: &muted}),
+		newResponse(MediaStateChange, MediaStateMessage{RoomID: "r", UserID: 2, AudioMuted: &muted}),
+		newResponse(Offer, nil),
+		newResponse(MediaStateChange, MediaStateMessage{RoomID: "r", UserID: 1, AudioMuted: &unmuted}),
+		newResponse(ActiveSpeaker, ActiveSpeakerMessage{RoomID: "r", UserID: 1}),
+		newResponse(ActiveSpeaker, ActiveSpeakerMessage{RoomID: "r", UserID: 2}),
+	}
+
+	for _, msg := range pushes {
+		if _, err := q.push(msg); err != nil {
+			t.Fatalf("push %s: %v", msg.Type, err)
+		}
+	}
+
+	messages, _ := q.pop()
+	if len(messages) != 4 {
+		t.Fatalf("queue has %d messages, want 4", len(messages))
+	}
+
+	if got := messages[0].Payload.(MediaStateMessage); got.UserID != 2 {
+		t.Errorf("first message is about user %d, want the media state of user 2", got.UserID)
+	}
+
+	if got := messages[2].Payload.(MediaStateMessage); got.UserID != 1 || *got.AudioMuted {
+		t.Errorf("media state of user 1 is %+v, want the latest one", got)
+	}
+
+	if got := messages[3].Payload.(ActiveSpeakerMessage); got.UserID != 2 {
+		t.Errorf("active speaker is %d, want the latest one", got.UserID)
+	}
+}
+
+func TestSendQueueClose(t *testing.T) {
+	q := newSendQueue(10)
+	fillQueue(t, q, Offer, 3)
+	q.close()
+	q.close()
+
+	if _, err := q.push(newResponse(Answer, nil)); err != errQueueClosed {
+		t.Errorf("push after close = %v, want %v", err, errQueueClosed)
+	}
+
+	// the write pump still gets what was queued before the queue was closed.
+	select {
+	case <-q.ready:
+	default:
+		t.Fatal("close did not signal the write pump")
+	}
+
+	messages, closed := q.pop()
+	if len(messages) != 3 || !closed {
+		t.Errorf("pop = %d messages, closed %v, want 3 messages, closed", len(messages), closed)
+	}
+}
+
+func TestSendQueueAbort(t *testing.T) {
+	q := newSendQueue(10)
+	fillQueue(t, q, Offer, 3)
+	q.abort()
+
+	if _, err := q.push(newResponse(Answer, nil)); err != errQueueClosed {
+		t.Errorf("push after abort = %v, want %v", err, errQueueClosed)
+	}
+
+	select {
+	case <-q.ready:
+	default:
+		t.Fatal("abort did not signal the write pump")
+	}
+
+	messages, closed := q.pop()
+	if len(messages) != 0 || !closed {
+		t.Errorf("pop = %d messages, closed %v, want none, closed", len(messages), closed)
+	}
+}
@@ -0,0 +1,73 @@
+package talky
+
+import (
+	"github.com/iamsayantan/talky/metrics"
+	"github.com/iamsayantan/talky/ratelimit"
+	"log"
+	"strconv"
+)
+
+// ErrRateLimited is sent back for the messages over the rate limits.
+var ErrRateLimited = &ProtocolError{Code: CodeRateLimited, Message: "too many messages, slow down"}
+
+// RateLimits are the limits on the messages the users send over the websocket. They are kept per
+// user rather than per connection, so connecting again doesn't reset them. The zero value doesn't
+// limit anything.
+type RateLimits struct {
+	// Connection limits all the messages of a user together.
+	Connection ratelimit.Limit
+
+	// Types limit the messages of a single type, on top of the connection limit.
+	Types map[string]ratelimit.Limit
+
+	// Violations limits how often a user may go over the limits, the user is disconnected once they
+	// go beyond it.
+	Violations ratelimit.Limit
+}
+
+// WithRateLimits makes the hub reject the messages over the limits, before any other middleware.
+func WithRateLimits(limits RateLimits) HubOption {
+	return func(h *Hub) {
+		h.Use(h.rateLimit(limits))
+	}
+}
+
+// rateLimit is the middleware enforcing the rate limits. The payload is not decoded yet when it
+// runs, so the messages over the limits are cheap to turn down.
+func (h *Hub) rateLimit(limits RateLimits) Middleware {
+	connection := ratelimit.NewLimiter(limits.Connection)
+	violations := ratelimit.NewLimiter(limits.Violations)
+	types := make(map[string]*ratelimit.Limiter)
+	for msgType, limit := range limits.Types {
+		types[msgType] = ratelimit.NewLimiter(limit)
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(req *Request) error {
+			key := strconv.FormatUint(uint64(req.User.ID), 10)
+
+			allowed, _ := connection.Allow(key)
+			if limiter, ok := types[req.Message.Type]; ok && allowed {
+				allowed, _ = limiter.Allow(key)
+			}
+
+			if allowed {
+				return next(req)
+			}
+
+			metrics.RateLimited.WithLabelValues(h.messageTypeLabel(req.Message.Type)).Inc()
+			if ok, _ := violations.Allow(key); ok {
+				return ErrRateLimited
+			}
+
+			log.Printf("User %d keeps going over the rate limits, disconnecting", req.User.ID)
+			metrics.RateLimitDisconnects.Inc()
+
+			// the error is queued before the disconnect, so the client still learns why.
+			req.client.reply(req.Message, ErrRateLimited)
+			req.deferred = true
+			h.disconnect(req.client)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the buckets which filled up again are dropped.
+const sweepInterval = time.Minute
+
+// Limit lets Burst events through at once and refills them at Rate per second. The zero Limit
+// doesn't limit anything.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited reports if the limit lets everything through.
+func (l Limit) Unlimited() bool {
+	return l.Burst <= 0
+}
+
+func (l Limit) String() string {
+	return strconv.FormatFloat(l.Rate, 'f', -1, 64) + ":" + strconv.Itoa(l.Burst)
+}
+
+// ParseLimit parses a limit written as rate:burst, like 0.5:10 for ten events at once and one
+// more every two seconds. An empty string is the zero Limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Limit{}, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("limit %q is not in the rate:burst format", s)
+	}
+
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return Limit{}, fmt.Errorf("invalid rate in limit %q", s)
+	}
+
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst < 0 {
+		return Limit{}, fmt.Errorf("invalid burst in limit %q", s)
+	}
+
+	return Limit{Rate: rate, Burst: burst}, nil
+}
+
+// ParseLimits parses comma separated name=rate:burst pairs, like OFFER=1:5,ICE_CANDIDATE=20:50.
+func ParseLimits(s string) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("limit %q is not in the name=rate:burst format", item)
+		}
+
+		limit, err := ParseLimit(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+
+	return limits, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a token bucket per key, a client IP address or a user for example. It is safe to
+// use from multiple goroutines.
+type Limiter struct {
+	limit Limit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewLimiter creates a limiter giving every key the same limit.
+func NewLimiter(limit Limit) *Limiter {
+	return &Limiter{
+		limit:     limit,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the key. When the bucket is empty it returns false and
+// how long it takes for the next token to come.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.limit.Unlimited() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if l.limit.Rate == 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+// sweep drops the buckets which are full again, they are the same as no bucket at all. It runs at
+// most once per sweep interval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval || l.limit.Rate == 0 {
+		return
+	}
+
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
@@ -0,0 +1,27 @@
+package talky
+
+// Role decides what a user is allowed to do. Every role includes the permissions of the roles below it.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// IsValid reports if the role is one of the known roles.
+func (r Role) IsValid() bool {
+	_, ok := roleLevels[r]
+	return ok
+}
+
+// Includes reports if the role has at least the permissions of the other role.
+func (r Role) Includes(other Role) bool {
+	return roleLevels[r] >= roleLevels[other]
+}
@@ -3,12 +3,27 @@ package talky
 import (
 	"errors"
 	"log"
-	"sync"
+	"sort"
+	"time"
 )
 
 var (
 	ErrAlreadyInRoom    = errors.New("already a member of the room")
 	ErrRoomCapacityFull = errors.New("room capacity is full")
+	ErrRoomNotFound     = errors.New("room not found")
+	ErrNotRoomMember    = errors.New("member not found")
+	ErrGuestRoom        = errors.New("guests can only join the room they were invited to")
+	ErrMissingScope     = errors.New("not allowed by the api key scopes")
+
+	ErrIdentityKeyRequired = errors.New("an identity key is required to join an end-to-end encrypted room")
+	ErrRecordingNotAllowed = errors.New("end-to-end encrypted rooms can't be recorded")
+	ErrNotEncryptedRoom    = errors.New("room is not end-to-end encrypted")
+	ErrStaleKeyEpoch       = errors.New("key was made for an older key epoch of the room")
+
+	ErrScreenShareNotAllowed = errors.New("screen sharing is not allowed in the room")
+	ErrTooManyScreenShares   = errors.New("too many members are already sharing their screen")
+	ErrNotSharingScreen      = errors.New("member is not sharing their screen")
+	ErrNotHost               = errors.New("only the host of the room or a moderator can change another member")
 )
 
 type RoomType string
@@ -23,36 +38,170 @@ const (
 	MaxMembersInAudioVideoRoom = 4
 )
 
+// roomMailboxSize is how many messages can wait for a busy room before the hub has to wait for it.
+const roomMailboxSize = 256
+
+// roomTask is work waiting in the mailbox of a room.
+type roomTask struct {
+	run  func()
+	drop func() // drop, unless nil, is called instead of run when the room stops before getting to it.
+}
+
 // Room defines the data structure for the room where the actual call will take place.
 // Room data is not store in the database, instead this will be an in memory collection
 // inside the running application.
+//
+// Every room runs in its own goroutine, which is the only one touching the members and the call.
+// Everything else hands work over to the room through its mailbox.
 type Room struct {
 	ID       string         `json:"id"`        // ID UUID string generated by client side
 	RoomType RoomType       `json:"room_type"` // RoomType What kind of communication we allow inside the room is determined by this.
 	Members  map[uint]*User `json:"members"`   // Members All the users who joined the room.
 
-	mu sync.Mutex
+	// RelayOnly rooms only relay the relay candidates, so the members connect through the TURN
+	// servers without learning each others addresses. It is set when the room is created.
+	RelayOnly bool `json:"relay_only"`
+
+	// E2EE rooms are end-to-end encrypted, the members exchange their media keys through the room
+	// and rotate them whenever someone joins or leaves. It is set when the room is created.
+	E2EE bool `json:"e2ee"`
+
+	// Host is the user who created the room. They stay the host when they leave and join again, and
+	// may stop the screen shares of the other members.
+	Host uint `json:"host"`
+
+	// MaxScreenShares is how many members may share their screen at the same time, zero doesn't
+	// allow screen sharing. It is set when the room is created.
+	MaxScreenShares int `json:"max_screen_shares"`
+
+	call    *Call            // call keeps track of who was in the room and when, it is stored when the room is removed.
+	clients map[uint]*Client // clients are the connections of the members, the room sends its messages to them.
+	mailbox chan roomTask    // mailbox holds the work waiting to run in the goroutine of the room.
+	quit    chan struct{}    // quit is closed when the room is removed from the hub.
+	stopped chan struct{}    // stopped is closed once the goroutine of the room has returned.
+
+	keyEpoch     uint64                // keyEpoch counts the key rotations of an end-to-end encrypted room.
+	screenShares []ScreenShare         // screenShares are the screens being shared, in the order they were started.
+	states       map[uint]*MemberState // states are what the members told the others about themselves.
+	chat         []ChatMessage         // chat holds the latest chat messages of the room.
+	speakers     speakerDetector       // speakers picks the dominant speaker from the audio levels of the members.
 }
 
-// NewRoom
+// NewRoom creates the room and starts its goroutine, which runs until the hub stops the room.
 func NewRoom(roomType RoomType, roomId string) *Room {
-	return &Room{
+	room := &Room{
 		ID:       roomId,
 		RoomType: roomType,
 		Members:  make(map[uint]*User),
+		clients:  make(map[uint]*Client),
+		states:   make(map[uint]*MemberState),
+		mailbox:  make(chan roomTask, roomMailboxSize),
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	room.call = newCall(room)
+	go room.run()
+	return room
+}
+
+func (r *Room) run() {
+	defer close(r.stopped)
+
+	for {
+		select {
+		case task := <-r.mailbox:
+			task.run()
+		case <-r.quit:
+			r.dropTasks()
+			return
+		}
+	}
+}
+
+// dropTasks empties the mailbox of the stopped room, so whoever is waiting for the dropped work
+// hears about it.
+func (r *Room) dropTasks() {
+	for {
+		select {
+		case task := <-r.mailbox:
+			if task.drop != nil {
+				task.drop()
+			}
+		default:
+			return
+		}
 	}
 }
 
-// AddMember Adds a new user to a room. Rooms have different capacity for members based on the room type.
-func (r *Room) AddMember(user *User) error {
-	var maxAllowedMembers int
+// post queues fn to run in the goroutine of the room without waiting for it. It returns false when
+// the room was already stopped.
+func (r *Room) post(fn func()) bool {
+	return r.postOrDrop(fn, nil)
+}
+
+// postOrDrop is post with drop called instead of fn when the room stops before fn could run.
+func (r *Room) postOrDrop(fn, drop func()) bool {
+	// a stopped room may still have room in its mailbox, which nobody would empty anymore.
+	select {
+	case <-r.quit:
+		return false
+	default:
+	}
+
+	select {
+	case r.mailbox <- roomTask{run: fn, drop: drop}:
+		return true
+	case <-r.quit:
+		return false
+	}
+}
+
+// do runs fn in the goroutine of the room and waits for it. It returns false when the room was
+// already stopped, fn did not run then.
+func (r *Room) do(fn func()) bool {
+	done := make(chan struct{})
+	if !r.post(func() {
+		fn()
+		close(done)
+	}) {
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-r.stopped:
+		// fn may have been the last thing the room did before it stopped.
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// stop ends the goroutine of the room, the work still waiting in the mailbox is dropped. Only the
+// hub stops rooms, once. The work the hub posted before is either done or dropped, as the hub
+// can't post to the room anymore after it.
+func (r *Room) stop() {
+	close(r.quit)
+}
+
+// capacity returns how many members the room can have, which depends on the room type.
+func (r *Room) capacity() int {
 	if r.RoomType == AudioRoom {
-		maxAllowedMembers = MaxMembersInAudioRoom
-	} else {
-		maxAllowedMembers = MaxMembersInAudioVideoRoom
+		return MaxMembersInAudioRoom
 	}
 
-	if len(r.Members) >= maxAllowedMembers {
+	return MaxMembersInAudioVideoRoom
+}
+
+// addMember adds a new user to a room. Rooms have different capacity for members based on the room type.
+func (r *Room) addMember(client *Client, media MediaState) error {
+	user := client.user
+	if len(r.Members) >= r.capacity() {
 		return ErrRoomCapacityFull
 	}
 
@@ -60,25 +209,313 @@ func (r *Room) AddMember(user *User) error {
 		return ErrAlreadyInRoom
 	}
 
-	r.mu.Lock()
+	if r.E2EE && user.IsRecorder() {
+		return ErrRecordingNotAllowed
+	}
+
+	if r.E2EE && user.IdentityKey == "" {
+		return ErrIdentityKeyRequired
+	}
+
 	r.Members[user.ID] = user
-	r.mu.Unlock()
+	r.clients[user.ID] = client
+	r.states[user.ID] = &MemberState{User: *user, MediaState: media, JoinedAt: time.Now()}
+	r.call.join(user)
 
 	log.Printf("Added user %s to room %s. Current members: %d", user.Username, r.ID, len(r.Members))
 	return nil
 }
 
-// RemoveMember Removes the user from the rooms member list.
-func (r *Room) RemoveMember(user *User) error {
-	if _, ok := r.Members[user.ID]; !ok {
+// removeMember removes the user from the rooms member list and returns how many members are left.
+func (r *Room) removeMember(userID uint) int {
+	user, ok := r.Members[userID]
+	if !ok {
 		// Ignoring if user who is being removed does not exist in the room.
-		return nil
+		return len(r.Members)
 	}
 
-	r.mu.Lock()
-	delete(r.Members, user.ID)
-	r.mu.Unlock()
+	delete(r.Members, userID)
+	delete(r.clients, userID)
+	delete(r.states, userID)
+	r.speakers.remove(userID)
+	r.call.leave(userID)
+	r.removeScreenShare(userID)
 
 	log.Printf("Removed user %s from room %s. Current members: %d", user.Username, r.ID, len(r.Members))
+	return len(r.Members)
+}
+
+// attach makes the room send the messages of the member to their new connection, which gets the
+// state of the room first as the old one may have missed some of its changes.
+func (r *Room) attach(client *Client) {
+	if _, ok := r.Members[client.user.ID]; ok {
+		r.clients[client.user.ID] = client
+		client.send(newResponse(RoomState, r.snapshot()))
+	}
+}
+
+// join adds the user to the room and tells every member, including the new one, about it. The new
+// member gets the state of the room as well.
+func (r *Room) join(client *Client, isInitiator bool, media MediaState) error {
+	if err := r.addMember(client, media); err != nil {
+		return err
+	}
+
+	joined := RoomJoined{
+		RoomID:      r.ID,
+		User:        *client.user,
+		IsInitiator: isInitiator,
+		IsGuest:     client.user.Guest,
+		RelayOnly:   r.RelayOnly,
+		E2EE:        r.E2EE,
+
+		// the members encode the message in their own goroutines, while the room goes on changing.
+		ScreenShares: append([]ScreenShare(nil), r.screenShares...),
+	}
+
+	if r.E2EE {
+		r.keyEpoch++
+		joined.KeyEpoch = r.keyEpoch
+		joined.IdentityKey = client.user.IdentityKey
+	}
+
+	// RoomJoin message should be broadcast to all users in the room.
+	r.broadcast(newResponse(RoomJoin, joined), 0)
+	_ = r.sendTo(client.user.ID, newResponse(RoomState, r.snapshot()))
+	if r.E2EE {
+		r.rotateKeys(KeyRotationJoin, client.user.ID)
+	}
+
 	return nil
 }
+
+// leave removes the user from the room and, unless resp is nil, sends it to the remaining members.
+// The reason is passed on to the members when they have to rotate their keys. It returns how many
+// members are left.
+func (r *Room) leave(userID uint, resp *ResponseMessage, reason string) int {
+	_, member := r.Members[userID]
+	sharing := r.screenShareIndex(userID) >= 0
+	remaining := r.removeMember(userID)
+	if resp != nil {
+		r.broadcast(resp, userID)
+	}
+
+	if sharing {
+		r.broadcast(newResponse(ScreenShareStop, ScreenShareStopMessage{RoomID: r.ID, UserID: userID, StoppedBy: userID}), 0)
+	}
+
+	if r.E2EE && member && remaining > 0 {
+		r.keyEpoch++
+		r.rotateKeys(reason, userID)
+	}
+
+	return remaining
+}
+
+// rotateKeys asks the members of an end-to-end encrypted room to make new media keys for the current
+// key epoch, which the membership change that caused it has already started.
+func (r *Room) rotateKeys(reason string, userID uint) {
+	members := make([]uint, 0, len(r.Members))
+	for id := range r.Members {
+		members = append(members, id)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+
+	r.broadcast(newResponse(KeyRotation, KeyRotationMessage{
+		RoomID:  r.ID,
+		Epoch:   r.keyEpoch,
+		Reason:  reason,
+		UserID:  userID,
+		Members: members,
+	}), 0)
+}
+
+// relayKey sends the encrypted media key of a member to the member it was encrypted for.
+func (r *Room) relayKey(payload KeyExchangeMessage) error {
+	if !r.E2EE {
+		return ErrNotEncryptedRoom
+	}
+
+	if _, ok := r.Members[payload.User.ID]; !ok {
+		return ErrNotRoomMember
+	}
+
+	if payload.Epoch != r.keyEpoch {
+		return ErrStaleKeyEpoch
+	}
+
+	return r.sendTo(payload.TargetUserID, newResponse(KeyExchange, payload))
+}
+
+// startScreenShare makes the stream of the member a shared screen and tells the other members. A
+// member sharing again, like after picking another window, replaces their stream.
+func (r *Room) startScreenShare(userID uint, streamID string) error {
+	if _, ok := r.Members[userID]; !ok {
+		return ErrNotRoomMember
+	}
+
+	if r.MaxScreenShares == 0 {
+		return ErrScreenShareNotAllowed
+	}
+
+	share := ScreenShare{UserID: userID, StreamID: streamID}
+	if i := r.screenShareIndex(userID); i >= 0 {
+		r.screenShares[i] = share
+	} else {
+		if len(r.screenShares) >= r.MaxScreenShares {
+			return ErrTooManyScreenShares
+		}
+
+		r.screenShares = append(r.screenShares, share)
+	}
+
+	r.broadcast(newResponse(ScreenShareStart, ScreenShareStartMessage{RoomID: r.ID, UserID: userID, StreamID: streamID}), userID)
+	return nil
+}
+
+// stopScreenShare ends the screen share of the member and tells every member, the sharer included
+// as it may have been stopped by the host or a moderator.
+func (r *Room) stopScreenShare(userID uint, by *User) error {
+	if _, ok := r.Members[by.ID]; !ok {
+		return ErrNotRoomMember
+	}
+
+	if userID != by.ID && !r.canModerate(by) {
+		return ErrNotHost
+	}
+
+	if !r.removeScreenShare(userID) {
+		return ErrNotSharingScreen
+	}
+
+	r.broadcast(newResponse(ScreenShareStop, ScreenShareStopMessage{RoomID: r.ID, UserID: userID, StoppedBy: by.ID}), 0)
+	return nil
+}
+
+// screenShareIndex returns the index of the screen share of the member, -1 when they aren't sharing.
+func (r *Room) screenShareIndex(userID uint) int {
+	for i, share := range r.screenShares {
+		if share.UserID == userID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// removeScreenShare removes the screen share of the member and reports if they had one.
+func (r *Room) removeScreenShare(userID uint) bool {
+	i := r.screenShareIndex(userID)
+	if i < 0 {
+		return false
+	}
+
+	r.screenShares = append(r.screenShares[:i], r.screenShares[i+1:]...)
+	return true
+}
+
+// close tells every member the room was closed and returns their ids.
+func (r *Room) close() []uint {
+	resp := newResponse(RoomClosed, RoomClosedMessage{RoomID: r.ID})
+
+	r.broadcast(resp, 0)
+
+	ids := make([]uint, 0, len(r.Members))
+	for id := range r.Members {
+		ids = append(ids, id)
+	}
+
+	log.Printf("Closed room %s with %d members", r.ID, len(r.Members))
+	return ids
+}
+
+// HasMember reports if the user is a member of the room. Like the other methods of the room, it
+// may only be called from the goroutine of the room, see Request.InRoom.
+func (r *Room) HasMember(userID uint) bool {
+	_, ok := r.Members[userID]
+	return ok
+}
+
+// Broadcast sends the message to every member of the room except the given user, zero sends it to
+// everyone.
+func (r *Room) Broadcast(msgType string, payload interface{}, except uint) {
+	r.broadcast(newResponse(msgType, payload), except)
+}
+
+// Send sends the message to a single member of the room.
+func (r *Room) Send(userID uint, msgType string, payload interface{}) error {
+	return r.sendTo(userID, newResponse(msgType, payload))
+}
+
+// broadcast sends the message to every member of the room except the given user.
+func (r *Room) broadcast(resp *ResponseMessage, except uint) {
+	for id, client := range r.clients {
+		if id == except {
+			continue
+		}
+		client.send(resp)
+	}
+}
+
+// sendTo sends the message to a single member of the room.
+func (r *Room) sendTo(userID uint, resp *ResponseMessage) error {
+	client, ok := r.clients[userID]
+	if !ok {
+		return ErrNotRoomMember
+	}
+
+	client.send(resp)
+	return nil
+}
+
+// members returns a copy of the members of the room.
+func (r *Room) members() []User {
+	members := make([]User, 0, len(r.Members))
+	for _, member := range r.Members {
+		members = append(members, *member)
+	}
+
+	return members
+}
+
+func (r *Room) propagateSDPOffer(payload SDPMessage) error {
+	resp := newResponse(Offer, payload)
+
+	return r.sendTo(payload.TargetUserID, resp)
+}
+
+func (r *Room) sendAnswer(payload SDPMessage) {
+	// answers should only be sent to the targeted user.
+	client, ok := r.clients[payload.TargetUserID]
+	if payload.TargetUserID == 0 || !ok {
+		log.Printf("Skipping sending answer to %d", payload.TargetUserID)
+		return
+	}
+
+	resp := newResponse(Answer, payload)
+
+	log.Printf("Sending answer to %d", payload.TargetUserID)
+	client.send(resp)
+}
+
+func (r *Room) sendICE(payload ICEMessage) error {
+	resp := newResponse(ICECandidate, payload)
+
+	return r.sendTo(payload.TargetUserID, resp)
+}
+
+// addStats attaches the stats report of the member to the call of the room.
+func (r *Room) addStats(userID uint, report StatsReport) error {
+	if _, ok := r.Members[userID]; !ok {
+		return ErrNotRoomMember
+	}
+
+	r.call.addStats(userID, report)
+	return nil
+}
+
+// endCall ends the call of the room and returns its record.
+func (r *Room) endCall() *Call {
+	r.call.end()
+	return r.call
+}
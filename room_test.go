@@ -0,0 +1,66 @@
+package talky
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestRoomStopDropsQueuedWork(t *testing.T) {
+	room := NewRoom(AudioRoom, "room")
+
+	// the room is kept busy until the work is queued and the room stopped.
+	busy := make(chan struct{})
+	room.post(func() { <-busy })
+
+	const tasks = 50
+	var ran, dropped int32
+	for i := 0; i < tasks; i++ {
+		posted := room.postOrDrop(func() {
+			atomic.AddInt32(&ran, 1)
+		}, func() {
+			atomic.AddInt32(&dropped, 1)
+		})
+
+		if !posted {
+			t.Fatal("postOrDrop failed on a running room")
+		}
+	}
+
+	room.stop()
+	close(busy)
+	<-room.stopped
+
+	if got := atomic.LoadInt32(&ran) + atomic.LoadInt32(&dropped); got != tasks {
+		t.Errorf("%d tasks ran or were dropped, want all %d", got, tasks)
+	}
+
+	if room.post(func() { t.Error("work ran in a stopped room") }) {
+		t.Error("post succeeded on a stopped room")
+	}
+
+	if room.do(func() { t.Error("work ran in a stopped room") }) {
+		t.Error("do succeeded on a stopped room")
+	}
+}
+
+func TestInRoomStoppedRoom(t *testing.T) {
+	room := NewRoom(AudioRoom, "room")
+	room.stop()
+
+	hub := &Hub{rooms: map[string]*Room{room.ID: room}}
+	client := &Client{hub: hub, user: &User{ID: 1}, queue: newSendQueue(10)}
+	req := &Request{Message: &Message{ID: "1", Type: Chat}, User: client.user, hub: hub, client: client}
+
+	err := req.InRoom(room.ID, func(room *Room) error {
+		t.Error("work ran in a stopped room")
+		return nil
+	})
+
+	if err != ErrRoomNotFound {
+		t.Errorf("InRoom = %v, want %v", err, ErrRoomNotFound)
+	}
+
+	if req.deferred {
+		t.Error("request is deferred to a stopped room, nobody would reply to it")
+	}
+}
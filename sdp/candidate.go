@@ -0,0 +1,188 @@
+package sdp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The types of the ICE candidates, RFC 8445.
+const (
+	CandidateHost  = "host"
+	CandidateSrflx = "srflx"
+	CandidatePrflx = "prflx"
+	CandidateRelay = "relay"
+)
+
+// Candidate is a parsed ICE candidate attribute, RFC 8839.
+type Candidate struct {
+	Foundation     string
+	Component      int
+	Transport      string
+	Priority       uint32
+	Address        string // Address is an ip address, or an mDNS name ending in .local.
+	Port           int
+	Type           string
+	RelatedAddress string
+	RelatedPort    int
+
+	// Extensions are the name and value pairs following the known fields, like generation 0.
+	Extensions []string
+}
+
+// ParseCandidate parses the candidate, with or without its a= and candidate: prefixes.
+func ParseCandidate(s string) (*Candidate, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "a="), "candidate:")
+
+	fields := strings.Fields(s)
+	if len(fields) < 8 || fields[6] != "typ" {
+		return nil, fmt.Errorf("%w: candidate needs a foundation, component, transport, priority, address, port and type", ErrMalformed)
+	}
+
+	c := &Candidate{
+		Foundation: fields[0],
+		Transport:  strings.ToLower(fields[2]),
+		Address:    fields[4],
+		Type:       fields[7],
+	}
+
+	var err error
+	if c.Component, err = strconv.Atoi(fields[1]); err != nil || c.Component < 1 || c.Component > 256 {
+		return nil, fmt.Errorf("%w: invalid candidate component %s", ErrMalformed, fields[1])
+	}
+
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid candidate priority %s", ErrMalformed, fields[3])
+	}
+	c.Priority = uint32(priority)
+
+	if c.Port, err = parsePort(fields[5]); err != nil {
+		return nil, err
+	}
+
+	if c.Transport != "udp" && c.Transport != "tcp" {
+		return nil, fmt.Errorf("%w: invalid candidate transport %s", ErrMalformed, fields[2])
+	}
+
+	if net.ParseIP(c.Address) == nil && !strings.HasSuffix(c.Address, ".local") {
+		return nil, fmt.Errorf("%w: invalid candidate address %s", ErrMalformed, c.Address)
+	}
+
+	switch c.Type {
+	case CandidateHost, CandidateSrflx, CandidatePrflx, CandidateRelay:
+	default:
+		return nil, fmt.Errorf("%w: invalid candidate type %s", ErrMalformed, c.Type)
+	}
+
+	rest := fields[8:]
+	if len(rest)%2 != 0 {
+		return nil, fmt.Errorf("%w: candidate extension without a value", ErrMalformed)
+	}
+
+	for i := 0; i < len(rest); i += 2 {
+		switch rest[i] {
+		case "raddr":
+			c.RelatedAddress = rest[i+1]
+		case "rport":
+			if c.RelatedPort, err = parsePort(rest[i+1]); err != nil {
+				return nil, err
+			}
+		default:
+			c.Extensions = append(c.Extensions, rest[i], rest[i+1])
+		}
+	}
+
+	return c, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("%w: invalid port %s", ErrMalformed, s)
+	}
+
+	return port, nil
+}
+
+// IsPrivate reports if the candidate gives away the local address of the peer. Those are the host
+// candidates, which carry the address of the network interface or an mDNS name standing for it.
+func (c *Candidate) IsPrivate() bool {
+	return c.Type == CandidateHost || IsPrivateAddress(c.Address)
+}
+
+// HideRelatedAddress replaces a private related address with 0.0.0.0 and port 0, which is what the
+// browsers send when they don't want to give it away either.
+func (c *Candidate) HideRelatedAddress() {
+	if c.RelatedAddress != "" && IsPrivateAddress(c.RelatedAddress) {
+		c.RelatedAddress = "0.0.0.0"
+		c.RelatedPort = 0
+	}
+}
+
+// String writes the candidate back as the value of the attribute, starting with candidate:.
+func (c *Candidate) String() string {
+	fields := []string{
+		"candidate:" + c.Foundation,
+		strconv.Itoa(c.Component),
+		c.Transport,
+		strconv.FormatUint(uint64(c.Priority), 10),
+		c.Address,
+		strconv.Itoa(c.Port),
+		"typ", c.Type,
+	}
+
+	if c.RelatedAddress != "" {
+		fields = append(fields, "raddr", c.RelatedAddress, "rport", strconv.Itoa(c.RelatedPort))
+	}
+
+	return strings.Join(append(fields, c.Extensions...), " ")
+}
+
+// privateNetworks are the address ranges which don't leave the local network.
+var privateNetworks = parseNetworks(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"127.0.0.0/8",
+	"fc00::/7",
+	"fe80::/10",
+	"::1/128",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+// IsPrivateAddress reports if the address is a private, loopback or link local one, or an mDNS name
+// which stands for one. The unspecified addresses are not, there is nothing to give away in them.
+func IsPrivateAddress(address string) bool {
+	if strings.HasSuffix(address, ".local") {
+		return true
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,136 @@
+package sdp
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCandidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		candidate string
+		want      Candidate
+		written   string // written is how the candidate is written back, when it differs.
+	}{
+		{
+			name:      "host",
+			candidate: "candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host generation 0",
+			want:      Candidate{Foundation: "1", Component: 1, Transport: "udp", Priority: 2122260223, Address: "192.168.1.20", Port: 54321, Type: CandidateHost, Extensions: []string{"generation", "0"}},
+		},
+		{
+			name:      "srflx with related address",
+			candidate: "candidate:2 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.20 rport 54321",
+			want:      Candidate{Foundation: "2", Component: 1, Transport: "udp", Priority: 1686052607, Address: "203.0.113.7", Port: 54321, Type: CandidateSrflx, RelatedAddress: "192.168.1.20", RelatedPort: 54321},
+		},
+		{
+			name:      "tcp relay over ipv6",
+			candidate: "candidate:3 2 TCP 41885439 2001:db8::9 443 typ relay raddr :: rport 0 tcptype passive",
+			want:      Candidate{Foundation: "3", Component: 2, Transport: "tcp", Priority: 41885439, Address: "2001:db8::9", Port: 443, Type: CandidateRelay, RelatedAddress: "::", Extensions: []string{"tcptype", "passive"}},
+			written:   "candidate:3 2 tcp 41885439 2001:db8::9 443 typ relay raddr :: rport 0 tcptype passive",
+		},
+		{
+			name:      "mdns host with attribute prefix",
+			candidate: "a=candidate:4 1 udp 2122260223 3f1c2d9e-8a1b.local 61000 typ host",
+			want:      Candidate{Foundation: "4", Component: 1, Transport: "udp", Priority: 2122260223, Address: "3f1c2d9e-8a1b.local", Port: 61000, Type: CandidateHost},
+			written:   "candidate:4 1 udp 2122260223 3f1c2d9e-8a1b.local 61000 typ host",
+		},
+		{
+			name:      "without prefix",
+			candidate: "5 1 udp 1 198.51.100.9 3478 typ prflx",
+			want:      Candidate{Foundation: "5", Component: 1, Transport: "udp", Priority: 1, Address: "198.51.100.9", Port: 3478, Type: CandidatePrflx},
+			written:   "candidate:5 1 udp 1 198.51.100.9 3478 typ prflx",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCandidate(tt.candidate)
+			if err != nil {
+				t.Fatalf("ParseCandidate: %v", err)
+			}
+
+			if !reflect.DeepEqual(*c, tt.want) {
+				t.Errorf("ParseCandidate = %+v, want %+v", *c, tt.want)
+			}
+
+			written := tt.written
+			if written == "" {
+				written = tt.candidate
+			}
+			if got := c.String(); got != written {
+				t.Errorf("String() = %s, want %s", got, written)
+			}
+		})
+	}
+}
+
+func TestParseCandidateMalformed(t *testing.T) {
+	tests := []struct {
+		name      string
+		candidate string
+	}{
+		{"empty", ""},
+		{"only the prefix", "candidate:"},
+		{"missing type", "candidate:1 1 udp 2122260223 192.168.1.20 54321"},
+		{"typ keyword missing", "candidate:1 1 udp 2122260223 192.168.1.20 54321 type host"},
+		{"component zero", "candidate:1 0 udp 2122260223 192.168.1.20 54321 typ host"},
+		{"component too large", "candidate:1 257 udp 2122260223 192.168.1.20 54321 typ host"},
+		{"component not a number", "candidate:1 rtp udp 2122260223 192.168.1.20 54321 typ host"},
+		{"priority overflow", "candidate:1 1 udp 4294967296 192.168.1.20 54321 typ host"},
+		{"negative priority", "candidate:1 1 udp -1 192.168.1.20 54321 typ host"},
+		{"port too large", "candidate:1 1 udp 2122260223 192.168.1.20 65536 typ host"},
+		{"port not a number", "candidate:1 1 udp 2122260223 192.168.1.20 http typ host"},
+		{"unknown transport", "candidate:1 1 sctp 2122260223 192.168.1.20 54321 typ host"},
+		{"hostname address", "candidate:1 1 udp 2122260223 evil.example.com 54321 typ host"},
+		{"address with a port", "candidate:1 1 udp 2122260223 192.168.1.20:80 54321 typ host"},
+		{"unknown type", "candidate:1 1 udp 2122260223 192.168.1.20 54321 typ bogus"},
+		{"extension without a value", "candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host generation"},
+		{"related port too large", "candidate:1 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.20 rport 70000"},
+		{"related port not a number", "candidate:1 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.20 rport x"},
+		{"oversized garbage", "candidate:" + strings.Repeat("x ", 100000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCandidate(tt.candidate)
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("ParseCandidate = %+v, %v, want %v", c, err, ErrMalformed)
+			}
+		})
+	}
+}
+
+func TestCandidatePrivacy(t *testing.T) {
+	tests := []struct {
+		candidate   string
+		private     bool
+		relatedKept bool // relatedKept reports if HideRelatedAddress keeps the related address.
+	}{
+		{"candidate:1 1 udp 1 192.168.1.20 5000 typ host", true, true},
+		{"candidate:1 1 udp 1 203.0.113.7 5000 typ host", true, true},
+		{"candidate:1 1 udp 1 abc.local 5000 typ host", true, true},
+		{"candidate:1 1 udp 1 10.1.2.3 5000 typ srflx raddr 10.1.2.3 rport 5000", true, false},
+		{"candidate:1 1 udp 1 203.0.113.7 5000 typ srflx raddr 192.168.1.20 rport 5000", false, false},
+		{"candidate:1 1 udp 1 203.0.113.7 5000 typ srflx raddr 198.51.100.1 rport 5000", false, true},
+		{"candidate:1 1 udp 1 198.51.100.9 3478 typ relay raddr fe80::1 rport 5000", false, false},
+	}
+
+	for _, tt := range tests {
+		c, err := ParseCandidate(tt.candidate)
+		if err != nil {
+			t.Fatalf("ParseCandidate(%s): %v", tt.candidate, err)
+		}
+
+		if got := c.IsPrivate(); got != tt.private {
+			t.Errorf("IsPrivate(%s) = %v, want %v", tt.candidate, got, tt.private)
+		}
+
+		related := c.RelatedAddress
+		c.HideRelatedAddress()
+		if kept := c.RelatedAddress == related; kept != tt.relatedKept {
+			t.Errorf("HideRelatedAddress(%s) left %s", tt.candidate, c.RelatedAddress)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package sdp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrMalformed is wrapped by the errors of the session descriptions and the candidates which could
+// not be parsed.
+var ErrMalformed = errors.New("malformed sdp")
+
+// staticPayloadTypes are the codecs of the payload types which don't need an rtpmap line, RFC 3551.
+var staticPayloadTypes = map[string]string{
+	"0":  "pcmu",
+	"3":  "gsm",
+	"4":  "g723",
+	"8":  "pcma",
+	"9":  "g722",
+	"13": "cn",
+	"18": "g729",
+	"26": "jpeg",
+	"31": "h261",
+	"34": "h263",
+}
+
+// Line is a single type=value line of a session description.
+type Line struct {
+	Type  byte
+	Value string
+}
+
+func (l Line) String() string {
+	return string(l.Type) + "=" + l.Value
+}
+
+// Media is a media section of a session description, from its m-line up to the next one.
+type Media struct {
+	Kind    string   // Kind of the media, like audio, video or application.
+	Port    string   // Port of the m-line, zero when the media is rejected. It may carry a port count.
+	Proto   string   // Proto is the transport protocol, like UDP/TLS/RTP/SAVPF.
+	Formats []string // Formats are the payload types of the rtp media.
+	Lines   []Line   // Lines are the lines following the m-line.
+}
+
+// Rejected reports if the media section is turned down, which is done with a zero port.
+func (m *Media) Rejected() bool {
+	return m.Port == "0"
+}
+
+// IsRTP reports if the formats of the media are rtp payload types. They are not for data channels.
+func (m *Media) IsRTP() bool {
+	return strings.Contains(m.Proto, "RTP")
+}
+
+// Codec returns the lower case name of the codec of the payload type, like opus or vp8.
+func (m *Media) Codec(payloadType string) string {
+	for _, line := range m.Lines {
+		if line.Type != 'a' || !strings.HasPrefix(line.Value, "rtpmap:"+payloadType+" ") {
+			continue
+		}
+
+		encoding := strings.TrimPrefix(line.Value, "rtpmap:"+payloadType+" ")
+		return strings.ToLower(strings.SplitN(encoding, "/", 2)[0])
+	}
+
+	return staticPayloadTypes[payloadType]
+}
+
+// RemoveFormats removes the payload types keep returns false for, along with their attributes.
+// It returns how many were removed.
+func (m *Media) RemoveFormats(keep func(payloadType, codec string) bool) int {
+	removed := make(map[string]bool)
+	formats := m.Formats[:0]
+	for _, pt := range m.Formats {
+		if keep(pt, m.Codec(pt)) {
+			formats = append(formats, pt)
+		} else {
+			removed[pt] = true
+		}
+	}
+	m.Formats = formats
+
+	if len(removed) == 0 {
+		return 0
+	}
+
+	lines := m.Lines[:0]
+	for _, line := range m.Lines {
+		if pt, ok := formatAttribute(line); ok && removed[pt] {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	m.Lines = lines
+
+	return len(removed)
+}
+
+// formatAttribute returns the payload type the attribute line belongs to, if it is one of the
+// attributes describing a payload type.
+func formatAttribute(line Line) (string, bool) {
+	if line.Type != 'a' {
+		return "", false
+	}
+
+	for _, name := range []string{"rtpmap:", "fmtp:", "rtcp-fb:"} {
+		if strings.HasPrefix(line.Value, name) {
+			return strings.SplitN(strings.TrimPrefix(line.Value, name), " ", 2)[0], true
+		}
+	}
+
+	return "", false
+}
+
+// SessionDescription is a parsed session description, RFC 4566. It keeps every line, so it is
+// written back the way it was parsed apart from the changes made to it.
+type SessionDescription struct {
+	Session []Line   // Session are the lines before the first media section.
+	Media   []*Media // Media are the media sections in their order.
+}
+
+// Parse parses the session description. Both CRLF and LF line endings are accepted.
+func Parse(s string) (*SessionDescription, error) {
+	lines := strings.Split(strings.TrimRight(s, "\r\n"), "\n")
+
+	desc := &SessionDescription{}
+	var media *Media
+	for i, raw := range lines {
+		line, err := parseLine(strings.TrimSuffix(raw, "\r"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrMalformed, i+1, err)
+		}
+
+		if i == 0 && line.String() != "v=0" {
+			return nil, fmt.Errorf("%w: it must start with v=0", ErrMalformed)
+		}
+
+		if line.Type == 'm' {
+			if media, err = parseMedia(line.Value); err != nil {
+				return nil, fmt.Errorf("%w: line %d: %v", ErrMalformed, i+1, err)
+			}
+
+			desc.Media = append(desc.Media, media)
+			continue
+		}
+
+		if media != nil {
+			media.Lines = append(media.Lines, line)
+		} else {
+			desc.Session = append(desc.Session, line)
+		}
+	}
+
+	for _, t := range []byte{'o', 's'} {
+		if !hasLine(desc.Session, t) {
+			return nil, fmt.Errorf("%w: missing the %c= line", ErrMalformed, t)
+		}
+	}
+
+	return desc, nil
+}
+
+func parseLine(s string) (Line, error) {
+	if len(s) < 2 || s[1] != '=' || s[0] < 'a' || s[0] > 'z' {
+		return Line{}, errors.New("not a type=value line")
+	}
+
+	for _, c := range s {
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return Line{}, errors.New("control character in the line")
+		}
+	}
+
+	return Line{Type: s[0], Value: s[2:]}, nil
+}
+
+func parseMedia(value string) (*Media, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 4 {
+		return nil, errors.New("m-line needs a media, port, protocol and formats")
+	}
+
+	port := strings.SplitN(fields[1], "/", 2)[0]
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid port %s", fields[1])
+	}
+
+	return &Media{
+		Kind:    fields[0],
+		Port:    fields[1],
+		Proto:   fields[2],
+		Formats: fields[3:],
+	}, nil
+}
+
+func hasLine(lines []Line, t byte) bool {
+	for _, line := range lines {
+		if line.Type == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterCandidates removes the candidate lines keep returns false for, keep may change the
+// candidates it keeps. It returns how many were removed, the lines which could not be parsed are
+// removed as well.
+func (d *SessionDescription) FilterCandidates(keep func(c *Candidate) bool) int {
+	removed := 0
+	for _, media := range d.Media {
+		lines := media.Lines[:0]
+		for _, line := range media.Lines {
+			if line.Type != 'a' || !strings.HasPrefix(line.Value, "candidate:") {
+				lines = append(lines, line)
+				continue
+			}
+
+			c, err := ParseCandidate(line.Value)
+			if err != nil || !keep(c) {
+				removed++
+				continue
+			}
+
+			lines = append(lines, Line{Type: 'a', Value: c.String()})
+		}
+		media.Lines = lines
+	}
+
+	return removed
+}
+
+// HidePrivateAddresses replaces the private addresses of the connection lines with 0.0.0.0, which
+// is what the browsers put there when they don't know their address yet.
+func (d *SessionDescription) HidePrivateAddresses() {
+	hide := func(lines []Line) {
+		for i, line := range lines {
+			fields := strings.Fields(line.Value)
+			if line.Type != 'c' || len(fields) != 3 || !IsPrivateAddress(strings.SplitN(fields[2], "/", 2)[0]) {
+				continue
+			}
+
+			lines[i].Value = fields[0] + " IP4 0.0.0.0"
+		}
+	}
+
+	hide(d.Session)
+	for _, media := range d.Media {
+		hide(media.Lines)
+	}
+}
+
+// String writes the session description back, with CRLF line endings.
+func (d *SessionDescription) String() string {
+	var b strings.Builder
+	write := func(line Line) {
+		b.WriteString(line.String())
+		b.WriteString("\r\n")
+	}
+
+	for _, line := range d.Session {
+		write(line)
+	}
+
+	for _, media := range d.Media {
+		write(Line{Type: 'm', Value: strings.Join(append([]string{media.Kind, media.Port, media.Proto}, media.Formats...), " ")})
+		for _, line := range media.Lines {
+			write(line)
+		}
+	}
+
+	return b.String()
+}
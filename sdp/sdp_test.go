@@ -0,0 +1,186 @@
+package sdp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const offer = "v=0\r\n" +
+	"o=- 4611731400430051336 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0 1\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111 0 126\r\n" +
+	"c=IN IP4 192.168.1.20\r\n" +
+	"a=mid:0\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n" +
+	"a=fmtp:111 minptime=10;useinbandfec=1\r\n" +
+	"a=rtcp-fb:111 transport-cc\r\n" +
+	"a=rtpmap:126 telephone-event/8000\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.20 54321 typ host generation 0\r\n" +
+	"a=candidate:2 1 udp 1686052607 203.0.113.7 54321 typ srflx raddr 192.168.1.20 rport 54321 generation 0\r\n" +
+	"a=candidate:3 1 udp 41885439 198.51.100.9 3478 typ relay raddr 203.0.113.7 rport 54321 generation 0\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:1\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=rtcp-fb:96 nack\r\n" +
+	"a=rtpmap:97 rtx/90000\r\n" +
+	"a=fmtp:97 apt=96\r\n"
+
+func TestParse(t *testing.T) {
+	desc, err := Parse(offer)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if len(desc.Media) != 2 || desc.Media[0].Kind != "audio" || desc.Media[1].Kind != "video" {
+		t.Fatalf("parsed %d media sections, want audio and video", len(desc.Media))
+	}
+
+	if got := desc.String(); got != offer {
+		t.Errorf("String() changed the session description:\n%s", got)
+	}
+
+	// the LF line endings are accepted too, the description is written back with CRLF.
+	desc, err = Parse(strings.Replace(offer, "\r\n", "\n", -1))
+	if err != nil {
+		t.Fatalf("Parse with LF line endings: %v", err)
+	}
+
+	if got := desc.String(); got != offer {
+		t.Errorf("String() of the LF session description:\n%s", got)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		sdp  string
+	}{
+		{"empty", ""},
+		{"only line endings", "\r\n\r\n"},
+		{"wrong version", "v=1\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\n"},
+		{"version not first", "o=- 1 1 IN IP4 0.0.0.0\r\nv=0\r\ns=-\r\n"},
+		{"missing origin", "v=0\r\ns=-\r\n"},
+		{"missing session name", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\n"},
+		{"origin only in media", "v=0\r\ns=-\r\nm=audio 9 RTP/AVP 0\r\no=- 1 1 IN IP4 0.0.0.0\r\n"},
+		{"line without a type", "v=0\r\n=foo\r\n"},
+		{"line without an equal sign", "v=0\r\nofoo\r\n"},
+		{"upper case type", "v=0\r\nO=- 1 1 IN IP4 0.0.0.0\r\n"},
+		{"single character", "v=0\r\no\r\n"},
+		{"empty line in between", "v=0\r\n\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\n"},
+		{"nul byte", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\x00\r\ns=-\r\n"},
+		{"bare carriage return", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\rs=-\r\n"},
+		{"escape sequence", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=\x1b[2J\r\n"},
+		{"delete character", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=\x7f\r\n"},
+		{"m-line without formats", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nm=audio 9 RTP/AVP\r\n"},
+		{"m-line port not a number", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nm=audio nine RTP/AVP 0\r\n"},
+		{"m-line port too large", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nm=audio 65536 RTP/AVP 0\r\n"},
+		{"m-line negative port", "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nm=audio -1 RTP/AVP 0\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.sdp)
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("Parse = %v, want %v", err, ErrMalformed)
+			}
+		})
+	}
+}
+
+func TestParseLargeInput(t *testing.T) {
+	// a session description at the size limit of the hub, with a single huge line and with very many
+	// small ones, is parsed like any other.
+	const size = 64 * 1024
+	head := "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\n"
+
+	long := head + "a=" + strings.Repeat("x", size-len(head)-4) + "\r\n"
+	many := head + strings.Repeat("a=x\r\n", (size-len(head))/5)
+
+	for _, s := range []string{long, many} {
+		desc, err := Parse(s)
+		if err != nil {
+			t.Fatalf("Parse of %d bytes: %v", len(s), err)
+		}
+
+		if got := desc.String(); got != s {
+			t.Errorf("String() of %d bytes returned %d bytes", len(s), len(got))
+		}
+	}
+
+	// a broken line at the very end of a large description is still found.
+	if _, err := Parse(many + "a=\x00\r\n"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Parse = %v, want %v", err, ErrMalformed)
+	}
+}
+
+func TestRemoveFormats(t *testing.T) {
+	desc, err := Parse(offer)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	audio := desc.Media[0]
+	if codec := audio.Codec("0"); codec != "pcmu" {
+		t.Errorf("Codec of the static payload type 0 = %s, want pcmu", codec)
+	}
+
+	removed := audio.RemoveFormats(func(_, codec string) bool {
+		return codec == "opus"
+	})
+
+	if removed != 2 || strings.Join(audio.Formats, " ") != "111" {
+		t.Errorf("removed %d formats leaving %v, want 2 removed leaving [111]", removed, audio.Formats)
+	}
+
+	for _, line := range audio.Lines {
+		if pt, ok := formatAttribute(line); ok && pt != "111" {
+			t.Errorf("attribute %s of a removed format was kept", line)
+		}
+	}
+
+	// the attributes which don't belong to a payload type stay.
+	if !strings.Contains(desc.String(), "a=candidate:1 ") || !strings.Contains(desc.String(), "a=mid:0") {
+		t.Error("RemoveFormats removed the attributes of the media")
+	}
+}
+
+func TestFilterCandidates(t *testing.T) {
+	desc, err := Parse(offer + "a=candidate:garbage\r\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	removed := desc.FilterCandidates(func(c *Candidate) bool {
+		return c.Type == CandidateRelay
+	})
+
+	// the host and the srflx candidates are dropped, and so is the one which doesn't parse.
+	if removed != 3 {
+		t.Errorf("FilterCandidates removed %d candidates, want 3", removed)
+	}
+
+	s := desc.String()
+	if strings.Contains(s, "typ host") || strings.Contains(s, "typ srflx") || strings.Contains(s, "garbage") {
+		t.Errorf("candidates left after filtering:\n%s", s)
+	}
+
+	if !strings.Contains(s, "typ relay") {
+		t.Error("the relay candidate was removed")
+	}
+}
+
+func TestHidePrivateAddresses(t *testing.T) {
+	desc, err := Parse(offer)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	desc.HidePrivateAddresses()
+	if s := desc.String(); strings.Contains(s, "c=IN IP4 192.168.1.20") {
+		t.Errorf("private connection address left:\n%s", s)
+	}
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+type updateRoleRequest struct {
+	Role talky.Role `json:"role"`
+}
+
+// adminUser is the user as seen by the admins, including the account status.
+type adminUser struct {
+	*account
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newAdminUser(user *talky.User) *adminUser {
+	return &adminUser{account: newAccount(user), Disabled: user.Disabled, CreatedAt: user.CreatedAt}
+}
+
+type adminHandler struct {
+	userRepo   store.UserRepository
+	apiKeyRepo store.APIKeyRepository
+	auditRepo  store.AuditRepository
+	callRepo   store.CallRepository
+	hub        *talky.Hub
+	throttle   *LoginThrottle
+	auditor    talky.Auditor
+}
+
+func newAdminHandler(config Config, hub *talky.Hub, throttle *LoginThrottle) *adminHandler {
+	return &adminHandler{
+		userRepo:   config.UserRepo,
+		apiKeyRepo: config.APIKeyRepo,
+		auditRepo:  config.AuditRepo,
+		callRepo:   config.CallRepo,
+		hub:        hub,
+		throttle:   throttle,
+		auditor:    config.Auditor,
+	}
+}
+
+// Route returns the admin routes. They expect the authenticate middleware to be already applied.
+func (ah *adminHandler) Route() chi.Router {
+	r := chi.NewRouter()
+
+	// moderators look after the rooms.
+	r.Group(func(r chi.Router) {
+		r.Use(requireRole(talky.RoleModerator))
+		r.Get("/stats", ah.stats)
+		r.Post("/users/{userID}/disconnect", ah.disconnectUser)
+		r.Delete("/rooms/{roomID}", ah.closeRoom)
+		r.Post("/rooms/{roomID}/members/{userID}/kick", ah.kickMember)
+		r.Get("/calls/alerts", ah.qualityAlerts)
+	})
+
+	// admins look after the accounts.
+	r.Group(func(r chi.Router) {
+		r.Use(requireRole(talky.RoleAdmin))
+		r.Get("/users", ah.listUsers)
+		r.Post("/users/{userID}/disable", ah.disableUser)
+		r.Post("/users/{userID}/enable", ah.enableUser)
+		r.Put("/users/{userID}/role", ah.updateRole)
+		r.Post("/users/{userID}/unlock", ah.unlockUser)
+		r.Post("/bots", ah.createBot)
+		r.Get("/users/{userID}/api-keys", ah.listAPIKeys)
+		r.Post("/users/{userID}/api-keys", ah.createAPIKey)
+		r.Delete("/api-keys/{keyID}", ah.revokeAPIKey)
+		r.Get("/audit", ah.listAuditEvents)
+		r.Get("/calls/export", ah.exportCalls)
+	})
+
+	return r
+}
+
+func (ah *adminHandler) listUsers(w http.ResponseWriter, r *http.Request) {
+	page, perPage := pagination(r)
+	users, total, err := ah.userRepo.ListUsers((page-1)*perPage, perPage)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	adminUsers := make([]*adminUser, 0, len(users))
+	for _, user := range users {
+		adminUsers = append(adminUsers, newAdminUser(user))
+	}
+
+	resp := struct {
+		Users   []*adminUser `json:"users"`
+		Page    int          `json:"page"`
+		PerPage int          `json:"per_page"`
+		Total   int          `json:"total"`
+	}{Users: adminUsers, Page: page, PerPage: perPage, Total: total}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (ah *adminHandler) disableUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if authUser, _ := r.Context().Value(KeyAuthUser).(*talky.User); authUser != nil && authUser.ID == user.ID {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "You can not disable your own account"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	ah.setDisabled(w, r, user, true)
+}
+
+func (ah *adminHandler) enableUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	ah.setDisabled(w, r, user, false)
+}
+
+func (ah *adminHandler) setDisabled(w http.ResponseWriter, r *http.Request, user *talky.User, disabled bool) {
+	if err := ah.userRepo.SetDisabled(user.ID, disabled); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	// only the changed column was written, the user is loaded again with the changes made meanwhile.
+	updated, err := ah.userRepo.FindById(user.ID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	action := talky.AuditUserEnable
+	if disabled {
+		log.Printf("Disabled user %d", user.ID)
+		ah.hub.DisconnectUser(user.ID)
+		action = talky.AuditUserDisable
+	}
+
+	event := auditEvent(r, action)
+	event.TargetUserID = user.ID
+	ah.auditor.Record(event)
+
+	resp := struct {
+		User *adminUser `json:"user"`
+	}{User: newAdminUser(updated)}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (ah *adminHandler) updateRole(w http.ResponseWriter, r *http.Request) {
+	var req updateRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if !req.Role.IsValid() {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid role"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	user, ok := ah.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	previous := user.Role
+	if err := ah.userRepo.UpdateRole(user.ID, req.Role); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	updated, err := ah.userRepo.FindById(user.ID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	event := auditEvent(r, talky.AuditRoleChange)
+	event.TargetUserID = user.ID
+	event.Detail = fmt.Sprintf("%s to %s", previous, req.Role)
+	ah.auditor.Record(event)
+
+	resp := struct {
+		User *adminUser `json:"user"`
+	}{User: newAdminUser(updated)}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (ah *adminHandler) unlockUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	locked := ah.throttle.Locked(user.Username)
+	ah.throttle.Unlock(user.Username)
+
+	event := auditEvent(r, talky.AuditAccountUnlock)
+	event.TargetUserID = user.ID
+	ah.auditor.Record(event)
+
+	resp := struct {
+		Username  string `json:"username"`
+		WasLocked bool   `json:"was_locked"`
+	}{Username: user.Username, WasLocked: locked}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (ah *adminHandler) disconnectUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid user id"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	ah.hub.DisconnectUser(uint(userID))
+
+	event := auditEvent(r, talky.AuditDisconnect)
+	event.TargetUserID = uint(userID)
+	ah.auditor.Record(event)
+
+	sendResponse(w, http.StatusOK, struct{}{})
+}
+
+func (ah *adminHandler) closeRoom(w http.ResponseWriter, r *http.Request) {
+	roomID := chi.URLParam(r, "roomID")
+	if err := ah.hub.CloseRoom(roomID); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	event := auditEvent(r, talky.AuditRoomClose)
+	event.RoomID = roomID
+	ah.auditor.Record(event)
+
+	sendResponse(w, http.StatusOK, struct{}{})
+}
+
+func (ah *adminHandler) kickMember(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid user id"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	roomID := chi.URLParam(r, "roomID")
+	if err := ah.hub.KickMember(roomID, uint(userID)); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	event := auditEvent(r, talky.AuditKick)
+	event.TargetUserID = uint(userID)
+	event.RoomID = roomID
+	ah.auditor.Record(event)
+
+	sendResponse(w, http.StatusOK, struct{}{})
+}
+
+func (ah *adminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Stats talky.HubStats `json:"stats"`
+	}{Stats: ah.hub.Stats()}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// findUser loads the user from the userID url parameter. It writes the error response and returns
+// false when the user can't be found.
+func (ah *adminHandler) findUser(w http.ResponseWriter, r *http.Request) (*talky.User, bool) {
+	userID, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid user id"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return nil, false
+	}
+
+	user, err := ah.userRepo.FindById(uint(userID))
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "user not found"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// requireRole only lets through the authenticated users who have at least the given role.
+func requireRole(role talky.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+			if !ok || !authUser.HasRole(role) {
+				errResp := struct {
+					Error string `json:"error"`
+				}{Error: "forbidden"}
+
+				sendResponse(w, http.StatusForbidden, errResp)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// allowScope lets the api keys with the scope use the route. It has to come before the
+// authentication, which turns down the api keys on every route that doesn't allow one of their scopes.
+func allowScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), keyAllowedScope, scope)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// pagination reads the page and per_page query parameters, falling back to the defaults when
+// they are missing or out of range.
+func pagination(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPageSize
+	}
+
+	if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+
+	return page, perPage
+}
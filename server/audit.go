@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditEvent starts an audit event of the request, with the authenticated user as the actor.
+func auditEvent(r *http.Request, action talky.AuditAction) *talky.AuditEvent {
+	event := &talky.AuditEvent{Action: action, IP: clientIP(r)}
+	if authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User); ok {
+		event.ActorID = authUser.ID
+		event.ActorName = authUser.Username
+	}
+
+	return event
+}
+
+func (ah *adminHandler) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if ah.auditRepo == nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "audit log is not enabled"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	filter, err := auditFilter(r)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	page, perPage := pagination(r)
+	events, total, err := ah.auditRepo.ListEvents(filter, (page-1)*perPage, perPage)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	if events == nil {
+		events = []*talky.AuditEvent{}
+	}
+
+	resp := struct {
+		Events  []*talky.AuditEvent `json:"events"`
+		Page    int                 `json:"page"`
+		PerPage int                 `json:"per_page"`
+		Total   int                 `json:"total"`
+	}{Events: events, Page: page, PerPage: perPage, Total: total}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// auditFilter reads the filters of the audit log from the query parameters. The since and until
+// parameters are RFC 3339 timestamps.
+func auditFilter(r *http.Request) (store.AuditFilter, error) {
+	q := r.URL.Query()
+	filter := store.AuditFilter{
+		Action: talky.AuditAction(q.Get("action")),
+		RoomID: q.Get("room_id"),
+	}
+
+	var err error
+	if filter.ActorID, err = uintParam(q.Get("actor_id")); err != nil {
+		return filter, errors.New("invalid actor_id")
+	}
+
+	if filter.TargetUserID, err = uintParam(q.Get("target_user_id")); err != nil {
+		return filter, errors.New("invalid target_user_id")
+	}
+
+	if filter.Since, err = timeParam(q.Get("since")); err != nil {
+		return filter, errors.New("invalid since")
+	}
+
+	if filter.Until, err = timeParam(q.Get("until")); err != nil {
+		return filter, errors.New("invalid until")
+	}
+
+	return filter, nil
+}
+
+func uintParam(value string) (uint, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(value, 10, 64)
+	return uint(id), err
+}
+
+func timeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/blob"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxAvatarSize is the maximum size of an uploaded avatar in bytes.
+	maxAvatarSize = 5 << 20
+
+	// maxAvatarDimension is the maximum width and height of an uploaded avatar, it protects us from
+	// small files which decode to huge images.
+	maxAvatarDimension = 4096
+
+	// avatarFormField is the multipart form field which holds the uploaded image.
+	avatarFormField = "avatar"
+)
+
+// avatarSizes are the sizes of the square thumbnails generated for every avatar, largest first.
+// The first one is served when no size is asked for.
+var avatarSizes = []int{256, 128, 64}
+
+var allowedAvatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+var (
+	errAvatarTooLarge    = errors.New("avatar must be smaller than 5MB")
+	errAvatarType        = errors.New("avatar must be a png, jpeg or gif image")
+	errAvatarDimensions  = errors.New("avatar must not be larger than 4096x4096 pixels")
+	errAvatarMissingFile = errors.New("avatar file is missing")
+)
+
+func (uh *userHandler) uploadAvatar(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	img, err := readAvatar(w, r)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	// every upload gets a new version in the url, so the thumbnails can be cached forever.
+	version, err := talky.RandomToken(8)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	prefix := avatarKeyPrefix(authUser.ID, version)
+	thumbnail := img
+	for _, size := range avatarSizes {
+		// each thumbnail is scaled from the previous one, which is a lot cheaper than going back
+		// to the original image every time.
+		thumbnail = resizeSquare(thumbnail, size)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, thumbnail); err == nil {
+			err = uh.avatars.Put(fmt.Sprintf("%s/%d.png", prefix, size), &buf)
+		}
+
+		if err != nil {
+			_ = uh.avatars.Delete(prefix)
+			errResp := struct {
+				Error string `json:"error"`
+			}{Error: err.Error()}
+
+			sendResponse(w, http.StatusInternalServerError, errResp)
+			return
+		}
+	}
+
+	previous := authUser.AvatarURL
+	if err := uh.userRepo.UpdateAvatar(authUser.ID, fmt.Sprintf("/avatars/%d/%s", authUser.ID, version)); err != nil {
+		_ = uh.avatars.Delete(prefix)
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	uh.deleteAvatar(previous)
+	uh.sendAccount(w, authUser.ID)
+}
+
+func (uh *userHandler) removeAvatar(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	previous := authUser.AvatarURL
+	if err := uh.userRepo.UpdateAvatar(authUser.ID, ""); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	uh.deleteAvatar(previous)
+	uh.sendAccount(w, authUser.ID)
+}
+
+// sendAccount sends the account of the user as it is stored after a change, only the changed
+// columns were written so the user loaded by the authentication is stale.
+func (uh *userHandler) sendAccount(w http.ResponseWriter, userID uint) {
+	updated, err := uh.userRepo.FindById(userID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	resp := struct {
+		User *account `json:"user"`
+	}{User: newAccount(updated)}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// serveAvatar returns the handler which sends the avatar thumbnails. The size query parameter picks
+// the smallest generated size which is not smaller than asked.
+func serveAvatar(storage blob.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		size := avatarSizes[0]
+		if requested, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+			for _, s := range avatarSizes {
+				if s >= requested {
+					size = s
+				}
+			}
+		}
+
+		key := fmt.Sprintf("%s/%d.png", avatarKeyPrefix(uint(userID), chi.URLParam(r, "version")), size)
+		rc, err := storage.Get(key)
+		if err != nil {
+			if err != blob.ErrNotFound && err != blob.ErrInvalidKey {
+				log.Printf("Error reading avatar %s: %v", key, err)
+			}
+
+			http.NotFound(w, r)
+			return
+		}
+		defer rc.Close()
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		_, _ = io.Copy(w, rc)
+	}
+}
+
+// deleteAvatar removes the stored thumbnails of an avatar url which is not used anymore.
+func (uh *userHandler) deleteAvatar(avatarURL string) {
+	parts := strings.Split(strings.TrimPrefix(avatarURL, "/avatars/"), "/")
+	if len(parts) != 2 {
+		return
+	}
+
+	userID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return
+	}
+
+	if err := uh.avatars.Delete(avatarKeyPrefix(uint(userID), parts[1])); err != nil {
+		log.Printf("Error deleting avatar %s: %v", avatarURL, err)
+	}
+}
+
+func avatarKeyPrefix(userID uint, version string) string {
+	return fmt.Sprintf("avatars/%d/%s", userID, version)
+}
+
+// readAvatar reads and decodes the uploaded avatar image after checking its size, type and dimensions.
+func readAvatar(w http.ResponseWriter, r *http.Request) (image.Image, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarSize+1<<10)
+	if err := r.ParseMultipartForm(maxAvatarSize); err != nil {
+		return nil, errAvatarTooLarge
+	}
+
+	file, header, err := r.FormFile(avatarFormField)
+	if err != nil {
+		return nil, errAvatarMissingFile
+	}
+	defer file.Close()
+
+	if header.Size > maxAvatarSize {
+		return nil, errAvatarTooLarge
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if !allowedAvatarTypes[http.DetectContentType(data)] {
+		return nil, errAvatarType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarType
+	}
+
+	if config.Width > maxAvatarDimension || config.Height > maxAvatarDimension {
+		return nil, errAvatarDimensions
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarType
+	}
+
+	return img, nil
+}
+
+// resizeSquare crops the centered square of the image and scales it to size x size pixels. Every
+// destination pixel is the average of the source pixels it covers, which is good enough for
+// thumbnails without pulling in an image processing library.
+func resizeSquare(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0, sy1 := y0+dy*side/size, y0+(dy+1)*side/size
+		if sy1 == sy0 {
+			sy1 = sy0 + 1
+		}
+
+		for dx := 0; dx < size; dx++ {
+			sx0, sx1 := x0+dx*side/size, x0+(dx+1)*side/size
+			if sx1 == sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(dx, dy, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
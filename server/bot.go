@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/iamsayantan/talky"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type createBotRequest struct {
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// apiKeyView is the json representation of an api key, the key itself is never part of it.
+type apiKeyView struct {
+	ID         uint       `json:"id"`
+	UserID     uint       `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func newAPIKeyView(key *talky.APIKey) *apiKeyView {
+	return &apiKeyView{
+		ID:         key.ID,
+		UserID:     key.UserID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes(),
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+// createBot creates a service account. Bots don't have a usable password, they authenticate with
+// the api keys created for them.
+func (ah *adminHandler) createBot(w http.ResponseWriter, r *http.Request) {
+	var req createBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || strings.TrimSpace(req.FirstName) == "" {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "username and first name can not be left blank"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if _, err := ah.userRepo.FindByUsername(req.Username); err == nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Username already taken"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	// nobody knows this password, so it is not possible to login as the bot.
+	unusable, err := talky.RandomToken(32)
+	if err == nil {
+		var hash []byte
+		hash, err = bcrypt.GenerateFromPassword([]byte(unusable), bcrypt.DefaultCost)
+		unusable = string(hash)
+	}
+
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	bot, err := ah.userRepo.CreateUser(&talky.User{
+		Username:  req.Username,
+		FirstName: strings.TrimSpace(req.FirstName),
+		LastName:  strings.TrimSpace(req.LastName),
+		Password:  unusable,
+		Role:      talky.RoleUser,
+		Bot:       true,
+	})
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	resp := struct {
+		User *adminUser `json:"user"`
+	}{User: newAdminUser(bot)}
+
+	sendResponse(w, http.StatusCreated, resp)
+}
+
+func (ah *adminHandler) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := ah.apiKeyRepo.ListByUser(user.ID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	views := make([]*apiKeyView, 0, len(keys))
+	for _, key := range keys {
+		views = append(views, newAPIKeyView(key))
+	}
+
+	resp := struct {
+		APIKeys []*apiKeyView `json:"api_keys"`
+	}{APIKeys: views}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (ah *adminHandler) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "at least one scope is required"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !talky.IsValidScope(scope) {
+			errResp := struct {
+				Error string `json:"error"`
+			}{Error: "invalid scope " + scope}
+
+			sendResponse(w, http.StatusBadRequest, errResp)
+			return
+		}
+	}
+
+	user, ok := ah.findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !user.Bot {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "api keys can only be created for bots"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	key, plain, err := talky.NewAPIKey(user.ID, strings.TrimSpace(req.Name), req.Scopes)
+	if err == nil {
+		key, err = ah.apiKeyRepo.CreateAPIKey(key)
+	}
+
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	event := auditEvent(r, talky.AuditAPIKeyCreate)
+	event.TargetUserID = user.ID
+	event.Detail = fmt.Sprintf("key %d with scopes %s", key.ID, key.ScopeList)
+	ah.auditor.Record(event)
+
+	resp := struct {
+		APIKey *apiKeyView `json:"api_key"`
+		Key    string      `json:"key"` // Key is only ever shown here, we only store its hash.
+	}{APIKey: newAPIKeyView(key), Key: plain}
+
+	sendResponse(w, http.StatusCreated, resp)
+}
+
+func (ah *adminHandler) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.ParseUint(chi.URLParam(r, "keyID"), 10, 64)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid api key id"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if err := ah.apiKeyRepo.Revoke(uint(keyID)); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "api key not found"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	log.Printf("Revoked api key %d", keyID)
+
+	event := auditEvent(r, talky.AuditAPIKeyRevoke)
+	event.Detail = fmt.Sprintf("key %d", keyID)
+	ah.auditor.Record(event)
+
+	sendResponse(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// callExportHeader is the header row of the call detail record export. Every row is one stay of a
+// participant in a call.
+var callExportHeader = []string{
+	"call_id", "room_id", "room_type", "started_at", "ended_at", "duration",
+	"user_id", "username", "guest", "joined_at", "left_at", "participant_duration",
+}
+
+// participantQuality is the quality a participant had in a call, along with what went wrong.
+type participantQuality struct {
+	talky.CallQuality
+	Username string   `json:"username"`
+	Poor     bool     `json:"poor"`
+	Issues   []string `json:"issues"`
+}
+
+// qualityReport is the quality of a call for every participant who sent stats.
+type qualityReport struct {
+	CallID       uint                  `json:"call_id"`
+	RoomID       string                `json:"room_id"`
+	StartedAt    time.Time             `json:"started_at"`
+	EndedAt      time.Time             `json:"ended_at"`
+	PoorQuality  bool                  `json:"poor_quality"`
+	Participants []*participantQuality `json:"participants"`
+}
+
+func newQualityReport(call *talky.Call) *qualityReport {
+	usernames := make(map[uint]string)
+	for _, p := range call.Participants {
+		usernames[p.UserID] = p.Username
+	}
+
+	report := &qualityReport{
+		CallID:       call.ID,
+		RoomID:       call.RoomID,
+		StartedAt:    call.StartedAt,
+		EndedAt:      call.EndedAt,
+		PoorQuality:  call.PoorQuality,
+		Participants: make([]*participantQuality, 0, len(call.Quality)),
+	}
+
+	for _, q := range call.Quality {
+		report.Participants = append(report.Participants, &participantQuality{
+			CallQuality: q,
+			Username:    usernames[q.UserID],
+			Poor:        q.IsPoor(),
+			Issues:      q.Issues(),
+		})
+	}
+
+	return report
+}
+
+type callHandler struct {
+	callRepo store.CallRepository
+}
+
+func newCallHandler(config Config) *callHandler {
+	return &callHandler{callRepo: config.CallRepo}
+}
+
+// Route returns the call history routes. They expect the authenticate middleware to be already applied.
+func (ch *callHandler) Route() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", ch.listCalls)
+	r.Get("/{callID}/quality", ch.quality)
+
+	return r
+}
+
+// listCalls returns the calls the authenticated user took part in, newest first.
+func (ch *callHandler) listCalls(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if ch.callRepo == nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "call history is not enabled"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	page, perPage := pagination(r)
+	calls, total, err := ch.callRepo.ListUserCalls(authUser.ID, (page-1)*perPage, perPage)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	if calls == nil {
+		calls = []*talky.Call{}
+	}
+
+	resp := struct {
+		Calls   []*talky.Call `json:"calls"`
+		Page    int           `json:"page"`
+		PerPage int           `json:"per_page"`
+		Total   int           `json:"total"`
+	}{Calls: calls, Page: page, PerPage: perPage, Total: total}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// quality returns the quality report of a call. Only the participants of the call and the
+// moderators can see it.
+func (ch *callHandler) quality(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if ch.callRepo == nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "call history is not enabled"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	callID, err := strconv.ParseUint(chi.URLParam(r, "callID"), 10, 64)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid call id"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	call, err := ch.callRepo.FindCall(uint(callID))
+	if err != nil || (!authUser.HasRole(talky.RoleModerator) && !participated(call, authUser.ID)) {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "call not found"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	resp := struct {
+		Quality *qualityReport `json:"quality"`
+	}{Quality: newQualityReport(call)}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// qualityAlerts lists the calls where a participant had a poor quality, newest first.
+func (ah *adminHandler) qualityAlerts(w http.ResponseWriter, r *http.Request) {
+	if ah.callRepo == nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "call history is not enabled"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	since, err := timeParam(r.URL.Query().Get("since"))
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid since"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	until, err := timeParam(r.URL.Query().Get("until"))
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid until"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	page, perPage := pagination(r)
+	calls, total, err := ah.callRepo.ListPoorCalls(since, until, (page-1)*perPage, perPage)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	alerts := make([]*qualityReport, 0, len(calls))
+	for _, call := range calls {
+		alerts = append(alerts, newQualityReport(call))
+	}
+
+	resp := struct {
+		Alerts  []*qualityReport `json:"alerts"`
+		Page    int              `json:"page"`
+		PerPage int              `json:"per_page"`
+		Total   int              `json:"total"`
+	}{Alerts: alerts, Page: page, PerPage: perPage, Total: total}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// exportCalls sends the call detail records of the calls started between the since and until
+// query parameters as a CSV file.
+func (ah *adminHandler) exportCalls(w http.ResponseWriter, r *http.Request) {
+	if ah.callRepo == nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "call history is not enabled"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	since, err := timeParam(r.URL.Query().Get("since"))
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid since"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	until, err := timeParam(r.URL.Query().Get("until"))
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid until"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	calls, err := ah.callRepo.ListCalls(since, until)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="calls-%s.csv"`, time.Now().Format("20060102-150405")))
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write(callExportHeader)
+	for _, call := range calls {
+		for _, p := range call.Participants {
+			_ = cw.Write([]string{
+				strconv.FormatUint(uint64(call.ID), 10),
+				csvCell(call.RoomID),
+				string(call.RoomType),
+				call.StartedAt.UTC().Format(time.RFC3339),
+				call.EndedAt.UTC().Format(time.RFC3339),
+				strconv.FormatInt(call.Duration, 10),
+				strconv.FormatUint(uint64(p.UserID), 10),
+				csvCell(p.Username),
+				strconv.FormatBool(p.Guest),
+				p.JoinedAt.UTC().Format(time.RFC3339),
+				p.LeftAt.UTC().Format(time.RFC3339),
+				strconv.FormatInt(p.Duration, 10),
+			})
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("Error exporting calls: %v", err)
+	}
+}
+
+// csvCell makes a cell of the export out of a value the users chose, like a room id or a guest
+// name. Values which a spreadsheet would take for a formula are prefixed with a quote, so opening the
+// export can't run them.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// participated reports if the user took part in the call.
+func participated(call *talky.Call, userID uint) bool {
+	for _, p := range call.Participants {
+		if p.UserID == userID {
+			return true
+		}
+	}
+
+	return false
+}
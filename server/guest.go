@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/iamsayantan/talky"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ScopeGuestLink is the scope of the tokens in the guest invitation links.
+	ScopeGuestLink = "guest_link"
+
+	// ScopeGuest is the scope of the access tokens given to the guests. They are only accepted
+	// for the websocket connection.
+	ScopeGuest = "guest"
+
+	// guestLinkTTL is how long a guest invitation link can be used.
+	guestLinkTTL = 24 * time.Hour
+
+	// guestTokenTTL is how long a guest can use the access token to connect.
+	guestTokenTTL = 2 * time.Hour
+
+	// maxDisplayNameLength is the maximum length of a guest's display name.
+	maxDisplayNameLength = 50
+
+	// guestIDBase is the smallest user id given to guests. The registered users get their ids from
+	// the unsigned 32 bit id column of the database, so they never reach it.
+	guestIDBase = 1 << 32
+)
+
+// lastGuestID counts the guests above guestIDBase. It starts at the time the server started in
+// microseconds, so the ids given out after a restart don't repeat the ones of the guest tokens
+// issued before it.
+var lastGuestID = uint64(time.Now().UnixNano() / int64(time.Microsecond))
+
+type guestJoinRequest struct {
+	Token       string `json:"token"`
+	DisplayName string `json:"display_name"`
+}
+
+// guestHandler lets the guests exchange their invitation link for an access token. The links
+// are created by the roomHandler.
+type guestHandler struct{}
+
+func newGuestHandler() *guestHandler {
+	return &guestHandler{}
+}
+
+// Route returns the public routes used by the guests.
+func (gh *guestHandler) Route() chi.Router {
+	r := chi.NewRouter()
+	r.Post("/join", gh.join)
+
+	return r
+}
+
+// join exchanges an invitation link token for a short lived guest access token.
+func (gh *guestHandler) join(w http.ResponseWriter, r *http.Request) {
+	var req guestJoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	displayName := strings.TrimSpace(req.DisplayName)
+	if displayName == "" || len([]rune(displayName)) > maxDisplayNameLength {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: fmt.Sprintf("display name must be between 1 and %d characters", maxDisplayNameLength)}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	link, err := parseToken(req.Token)
+	if err != nil || link.Scope != ScopeGuestLink {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid or expired invitation link"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	claims := &JWTClaims{
+		UserID:      newGuestID(),
+		Scope:       ScopeGuest,
+		RoomID:      link.RoomID,
+		RoomType:    link.RoomType,
+		DisplayName: displayName,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(guestTokenTTL).Unix(),
+		},
+	}
+
+	token, err := signToken(claims)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	resp := struct {
+		User        *talky.User    `json:"user"`
+		AccessToken string         `json:"access_token"`
+		RoomID      string         `json:"room_id"`
+		RoomType    talky.RoomType `json:"room_type"`
+	}{User: guestUser(claims), AccessToken: token, RoomID: link.RoomID, RoomType: link.RoomType}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// authenticateWs authenticates the websocket connections and the websocket tickets they are made
+// with. On top of the normal access tokens it also accepts the guest tokens.
+func (gh *guestHandler) authenticateWs(users WebHandler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := users.Authenticate(next)
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			claims, err := parseToken(r.Header.Get(AuthorizationHeader))
+			if err != nil || claims.Scope != ScopeGuest {
+				authenticated.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), KeyAuthUser, guestUser(claims))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// guestUser builds the in memory user of a guest from their token.
+func guestUser(claims *JWTClaims) *talky.User {
+	return &talky.User{
+		ID:          claims.UserID,
+		Username:    fmt.Sprintf("guest-%d", claims.UserID-guestIDBase),
+		FirstName:   claims.DisplayName,
+		Role:        talky.RoleUser,
+		Guest:       true,
+		GuestRoomID: claims.RoomID,
+	}
+}
+
+// newGuestID returns the next id of the guest id range. Every guest gets their own, two guests
+// with the same id would share their connection and their rooms in the hub.
+func newGuestID() uint {
+	return guestIDBase + uint(atomic.AddUint64(&lastGuestID, 1))
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewGuestID(t *testing.T) {
+	seen := make(map[uint]bool)
+	for i := 0; i < 100000; i++ {
+		id := newGuestID()
+		if id <= math.MaxUint32 {
+			t.Fatalf("guest id %d is in the range of the registered users", id)
+		}
+
+		if seen[id] {
+			t.Fatalf("guest id %d was given out twice", id)
+		}
+		seen[id] = true
+	}
+}
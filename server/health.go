@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// probeTimeout is how long the health checks wait for the hub and the database.
+	probeTimeout = 2 * time.Second
+
+	// drainPollInterval is how often Drain checks if the clients have left.
+	drainPollInterval = 500 * time.Millisecond
+)
+
+// healthz is the liveness probe, it only fails when the hub stopped responding.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	if err := s.hub.Ping(ctx); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "hub is not responding"}
+
+		sendResponse(w, http.StatusServiceUnavailable, errResp)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{Status: "ok"})
+}
+
+// readyz is the readiness probe. On top of the hub it checks the database, and it fails as soon as
+// the server starts draining so the load balancer sends the new connections elsewhere.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"hub": "ok", "database": "ok"}
+	ready := true
+
+	if atomic.LoadInt32(&s.draining) == 1 {
+		checks["server"] = "draining"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	if err := s.hub.Ping(ctx); err != nil {
+		checks["hub"] = err.Error()
+		ready = false
+	}
+
+	if s.db != nil {
+		if err := s.db.Ping(); err != nil {
+			checks["database"] = err.Error()
+			ready = false
+		}
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	resp := struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+	}{Ready: ready, Checks: checks}
+
+	sendResponse(w, status, resp)
+}
+
+// Drain stops accepting new websocket connections and asks the connected clients to reconnect.
+// It returns once every client left or the context is done, whichever comes first.
+func (s *Server) Drain(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+
+	s.hub.NotifyShutdown()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		clients := s.hub.Stats().ConnectedClients
+		if clients == 0 {
+			log.Printf("All clients left")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Drain period is over with %d clients still connected", clients)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close disconnects the remaining websocket clients.
+func (s *Server) Close() {
+	s.hub.DisconnectAll()
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/iamsayantan/talky"
+	"net/http"
+	"strconv"
+)
+
+type identityKeyRequest struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+}
+
+// identityKeyRoutes adds the routes of the identity keys, which the members of the end-to-end
+// encrypted rooms encrypt their media keys for each other with.
+func (uh *userHandler) identityKeyRoutes(r chi.Router) {
+	r.Get("/me/identity-key", uh.myIdentityKey)
+	r.Put("/me/identity-key", uh.setIdentityKey)
+	r.Delete("/me/identity-key", uh.deleteIdentityKey)
+	r.Get("/users/{userID}/identity-key", uh.userIdentityKey)
+}
+
+func (uh *userHandler) myIdentityKey(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	uh.sendIdentityKey(w, authUser.ID)
+}
+
+// userIdentityKey sends the identity key of another user, so the members of a room can check the
+// keys they got were made by who they claim.
+func (uh *userHandler) userIdentityKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid user id"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	uh.sendIdentityKey(w, uint(userID))
+}
+
+func (uh *userHandler) sendIdentityKey(w http.ResponseWriter, userID uint) {
+	key, err := uh.identityKeyRepo.FindByUser(userID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "identity key not found"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	resp := struct {
+		IdentityKey *talky.IdentityKey `json:"identity_key"`
+	}{IdentityKey: key}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// setIdentityKey registers the public identity key of the user, replacing the one they had. The
+// new key is used from the next websocket connection on.
+func (uh *userHandler) setIdentityKey(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	var req identityKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	key, err := talky.NewIdentityKey(authUser.ID, req.Algorithm, req.PublicKey)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	saved, err := uh.identityKeyRepo.SaveIdentityKey(key)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	event := auditEvent(r, talky.AuditIdentityKeySet)
+	event.Detail = saved.Fingerprint
+	uh.auditor.Record(event)
+
+	resp := struct {
+		IdentityKey *talky.IdentityKey `json:"identity_key"`
+	}{IdentityKey: saved}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (uh *userHandler) deleteIdentityKey(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if err := uh.identityKeyRepo.DeleteByUser(authUser.ID); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "identity key not found"}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	uh.auditor.Record(auditEvent(r, talky.AuditIdentityKeyDelete))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/iamsayantan/talky"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type updateProfileRequest struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+func (uh *userHandler) updateProfile(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	var req updateProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	user := *authUser
+	user.FirstName = strings.TrimSpace(req.FirstName)
+	user.LastName = strings.TrimSpace(req.LastName)
+	user.Email = strings.TrimSpace(req.Email)
+
+	if err := user.IsValid(); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	emailChanged := !strings.EqualFold(user.Email, authUser.Email)
+	if emailChanged {
+		if _, err := uh.userRepo.FindByEmail(user.Email); err == nil {
+			errResp := struct {
+				Error string `json:"error"`
+			}{Error: "Email already registered"}
+
+			sendResponse(w, http.StatusBadRequest, errResp)
+			return
+		}
+
+		user.EmailVerified = false
+	}
+
+	// only the changed columns are written, the user loaded by the authentication may be stale by now.
+	err := uh.userRepo.UpdateName(user.ID, user.FirstName, user.LastName)
+	if err == nil && emailChanged {
+		// the links sent to the old address must not verify the new one.
+		err = uh.tokenRepo.DeleteUserTokens(user.ID, talky.TokenEmailVerification)
+	}
+
+	if err == nil && emailChanged {
+		err = uh.userRepo.UpdateEmail(user.ID, user.Email)
+	}
+
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	updated, err := uh.userRepo.FindById(user.ID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	if emailChanged {
+		uh.sendVerificationEmail(updated)
+	}
+
+	resp := struct {
+		User *account `json:"user"`
+	}{User: newAccount(updated)}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (uh *userHandler) changePassword(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if req.NewPassword == "" {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "password can not be left blank"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if !uh.checkPassword(w, r, authUser, req.CurrentPassword) {
+		return
+	}
+
+	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	if err := uh.userRepo.UpdatePassword(authUser.ID, string(passwordBytes)); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	// changing the password revoked every access token of the user, including the one this request
+	// was made with, so they get a new one.
+	updated, err := uh.userRepo.FindById(authUser.ID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	token, err := uh.generateAuthToken(updated)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	resp := struct {
+		AccessToken string `json:"access_token"`
+	}{AccessToken: token}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (uh *userHandler) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	var req deleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if !uh.checkPassword(w, r, authUser, req.Password) {
+		return
+	}
+
+	if err := uh.userRepo.DeleteUser(authUser.ID); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	if uh.identityKeyRepo != nil {
+		_ = uh.identityKeyRepo.DeleteByUser(authUser.ID)
+	}
+
+	log.Printf("Deleted user %d", authUser.ID)
+	uh.hub.DisconnectUser(authUser.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkPassword verifies the password of the authenticated user before a sensitive change. The
+// failures count towards the login lockout, so a stolen access token can't be used to guess the
+// password. It writes the error response and returns false when the password is not correct.
+func (uh *userHandler) checkPassword(w http.ResponseWriter, r *http.Request, user *talky.User, password string) bool {
+	ip := clientIP(r)
+	if ok, _ := uh.throttle.Allow(user.Username, ip); !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Too many failed attempts, try again later"}
+
+		sendResponse(w, http.StatusTooManyRequests, errResp)
+		return false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		uh.throttle.Failure(user.Username, ip)
+
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "invalid password"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/iamsayantan/talky/ratelimit"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// ipv6NetworkBits is the size of the IPv6 networks limited together, a client usually gets a whole
+// /64 and could otherwise use a new address for every request.
+const ipv6NetworkBits = 64
+
+// rateLimit limits the requests from every client IP address. The address is the one the realIP
+// middleware trusts, the forwarding headers sent by anyone else don't change it. The requests over
+// the limit are turned down with the time to wait before trying again.
+func rateLimit(limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ok, wait := limiter.Allow(rateLimitKey(r)); !ok {
+				errResp := struct {
+					Error string `json:"error"`
+				}{Error: "Too many requests, try again later"}
+
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				sendResponse(w, http.StatusTooManyRequests, errResp)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey returns the client IP address the requests are limited by, the IPv6 addresses are
+// limited by their network.
+func rateLimitKey(r *http.Request) string {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return clientIP(r)
+	}
+
+	if ip.To4() != nil {
+		return ip.String()
+	}
+
+	return ip.Mask(net.CIDRMask(ipv6NetworkBits, 128)).String() + "/64"
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/iamsayantan/talky/ratelimit"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	_, proxy, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		limited    bool // limited reports if the requests with a new forwarded address each are limited together.
+	}{
+		{"untrusted client", "203.0.113.7:4000", true},
+		{"untrusted ipv6 client", "[2001:db8:1:2::7]:4000", true},
+		{"trusted proxy", "10.0.0.1:4000", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := ratelimit.NewLimiter(ratelimit.Limit{Rate: 0, Burst: 3})
+			handler := realIP([]*net.IPNet{proxy})(rateLimit(limiter)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+			rejected := 0
+			for i := 0; i < 10; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/login", nil)
+				req.RemoteAddr = tt.remoteAddr
+				req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i+1))
+
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code == http.StatusTooManyRequests {
+					rejected++
+				}
+			}
+
+			if limited := rejected > 0; limited != tt.limited {
+				t.Errorf("%d of 10 requests rejected, want limited %v", rejected, tt.limited)
+			}
+		})
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"203.0.113.7:4000", "203.0.113.7"},
+		{"[2001:db8:1:2:aaaa::7]:4000", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:bbbb::9]:4000", "2001:db8:1:2::/64"},
+		{"[::ffff:203.0.113.7]:4000", "203.0.113.7"},
+		{"garbage", "garbage"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if got := rateLimitKey(req); got != tt.want {
+			t.Errorf("rateLimitKey(%s) = %s, want %s", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
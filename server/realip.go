@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses the addresses and the CIDR ranges of the reverse proxies whose
+// forwarding headers are trusted, like 10.0.0.0/8 or 192.168.1.10.
+func ParseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %s", item)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %s: %w", item, err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// realIP replaces the RemoteAddr of the requests coming from one of the trusted proxies with the
+// address of the client they forwarded the request for. The forwarding headers of everyone else
+// are ignored, any client can send them to pick the address the login lockout and the rate limits
+// see.
+func realIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := forwardedFor(r, trusted); ip != "" {
+				r.RemoteAddr = ip
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor returns the address of the client a trusted proxy forwarded the request for, empty
+// when the request didn't come from a trusted proxy. X-Forwarded-For is read from the right, every
+// proxy appends the address it got the request from, so the first address which isn't a trusted
+// proxy is the client. The addresses left of it could have been made up by the client.
+func forwardedFor(r *http.Request, trusted []*net.IPNet) string {
+	if !isTrusted(net.ParseIP(clientIP(r)), trusted) {
+		return ""
+	}
+
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+		if !isTrusted(ip, trusted) {
+			return client
+		}
+	}
+
+	if client != "" {
+		return client
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "", "203.0.113.5"},
+		{"forged header from untrusted client", "203.0.113.5:4000", []string{"198.51.100.1"}, "198.51.100.2", "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"trusted single address", "192.168.1.10:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"untrusted address in the trusted range", "192.168.1.11:4000", []string{"198.51.100.1"}, "", "192.168.1.11"},
+		{"client prepends a forged hop", "10.0.0.2:4000", []string{"1.2.3.4, 198.51.100.1"}, "", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:4000", []string{"198.51.100.1, 10.0.0.3", "10.0.0.4"}, "", "198.51.100.1"},
+		{"garbage hop stops the walk", "10.0.0.2:4000", []string{"198.51.100.1, garbage, 10.0.0.3"}, "", "10.0.0.3"},
+		{"real ip header from trusted proxy", "10.0.0.2:4000", nil, "198.51.100.7", "198.51.100.7"},
+		{"trusted proxy without headers", "10.0.0.2:4000", nil, "", "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := realIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("client ip = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalid(t *testing.T) {
+	for _, value := range []string{"nope", "10.0.0.0/33", "10.0.0"} {
+		if _, err := ParseTrustedProxies([]string{value}); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/mail"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// emailVerificationTTL is how long the email verification links are valid.
+	emailVerificationTTL = 48 * time.Hour
+
+	// passwordResetTTL is how long the password reset links are valid.
+	passwordResetTTL = 1 * time.Hour
+)
+
+type tokenRequest struct {
+	Token string `json:"token"`
+}
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (uh *userHandler) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	token, err := uh.tokenRepo.ConsumeToken(talky.HashToken(req.Token), talky.TokenEmailVerification)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: talky.ErrInvalidToken.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if err := uh.userRepo.MarkEmailVerified(token.UserID); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	resp := struct {
+		EmailVerified bool `json:"email_verified"`
+	}{EmailVerified: true}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+func (uh *userHandler) resendVerification(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if authUser.EmailVerified {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Email is already verified"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	uh.sendVerificationEmail(authUser)
+	sendResponse(w, http.StatusAccepted, struct{}{})
+}
+
+func (uh *userHandler) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req forgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	// We always respond the same way, whether the email belongs to an account or not, so this
+	// endpoint can't be used to find out who is registered. The account is looked up in the
+	// background, or the time it takes to respond would give it away.
+	go uh.sendPasswordResetEmail(strings.TrimSpace(req.Email))
+
+	sendResponse(w, http.StatusAccepted, struct{}{})
+}
+
+func (uh *userHandler) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	if req.Password == "" {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "password can not be left blank"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	token, err := uh.tokenRepo.ConsumeToken(talky.HashToken(req.Token), talky.TokenPasswordReset)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: talky.ErrInvalidToken.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	user, err := uh.userRepo.FindById(token.UserID)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: talky.ErrInvalidToken.Error()}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	if err := uh.userRepo.UpdatePassword(user.ID, string(passwordBytes)); err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	// any other reset link which might be lying around in the mailbox is no longer needed.
+	_ = uh.tokenRepo.DeleteUserTokens(user.ID, talky.TokenPasswordReset)
+	uh.throttle.Unlock(user.Username)
+
+	sendResponse(w, http.StatusOK, struct{}{})
+}
+
+func (uh *userHandler) sendVerificationEmail(user *talky.User) {
+	link, err := uh.createTokenLink(user, talky.TokenEmailVerification, emailVerificationTTL, "/verify-email")
+	if err != nil {
+		log.Printf("Error creating email verification token for user %d: %v", user.ID, err)
+		return
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease verify your email address by opening the link below:\n\n%s\n\n"+
+			"The link is valid for %d hours.", user.FirstName, link, int(emailVerificationTTL.Hours())),
+	}
+
+	go uh.sendMail(msg)
+}
+
+// sendPasswordResetEmail mails a reset link to the account with the email, if there is one. It is
+// run in its own goroutine.
+func (uh *userHandler) sendPasswordResetEmail(email string) {
+	user, err := uh.userRepo.FindByEmail(email)
+	if err != nil {
+		return
+	}
+
+	link, err := uh.createTokenLink(user, talky.TokenPasswordReset, passwordResetTTL, "/reset-password")
+	if err != nil {
+		log.Printf("Error creating password reset token for user %d: %v", user.ID, err)
+		return
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your talky account %s. "+
+			"If it was you, open the link below to choose a new password:\n\n%s\n\n"+
+			"The link is valid for %d minutes. If you did not ask for it, you can ignore this email.",
+			user.FirstName, user.Username, link, int(passwordResetTTL.Minutes())),
+	}
+
+	uh.sendMail(msg)
+}
+
+// createTokenLink stores a new token for the user and returns the link to the web client page
+// which handles it.
+func (uh *userHandler) createTokenLink(user *talky.User, purpose talky.TokenPurpose, ttl time.Duration, path string) (string, error) {
+	token, plain, err := talky.NewUserToken(user.ID, purpose, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := uh.tokenRepo.CreateToken(token); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s?token=%s", uh.appURL, path, url.QueryEscape(plain)), nil
+}
+
+// sendMail delivers the message, it is run in its own goroutine because we don't want to keep
+// the request waiting for a slow SMTP server.
+func (uh *userHandler) sendMail(msg mail.Message) {
+	if err := uh.mailer.Send(msg); err != nil {
+		log.Printf("Error sending mail to %s: %v", msg.To, err)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/iamsayantan/talky"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type roomHandler struct {
+	hub          *talky.Hub
+	appURL       string
+	authenticate func(http.Handler) http.Handler
+}
+
+func newRoomHandler(hub *talky.Hub, appURL string, authenticate func(http.Handler) http.Handler) *roomHandler {
+	return &roomHandler{hub: hub, appURL: strings.TrimRight(appURL, "/"), authenticate: authenticate}
+}
+
+// Route returns the room routes. They are authenticated per route, as only the member list can be
+// read with an api key.
+func (rh *roomHandler) Route() chi.Router {
+	r := chi.NewRouter()
+	r.With(allowScope(talky.ScopeReadPresence), rh.authenticate).Get("/{roomID}/members", rh.members)
+	r.With(rh.authenticate).Post("/{roomID}/guest-links", rh.createGuestLink)
+
+	return r
+}
+
+// members lists who is in the room right now. Members of the room and moderators can always see it,
+// api keys need the presence scope.
+func (rh *roomHandler) members(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	roomID := chi.URLParam(r, "roomID")
+	_, isMember := rh.hub.RoomOfMember(roomID, authUser.ID)
+	if !isMember && !authUser.HasRole(talky.RoleModerator) && (authUser.Scopes == nil || !authUser.HasScope(talky.ScopeReadPresence)) {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "forbidden"}
+
+		sendResponse(w, http.StatusForbidden, errResp)
+		return
+	}
+
+	members, ok := rh.hub.RoomMembers(roomID)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: talky.ErrRoomNotFound.Error()}
+
+		sendResponse(w, http.StatusNotFound, errResp)
+		return
+	}
+
+	resp := struct {
+		RoomID  string       `json:"room_id"`
+		Members []talky.User `json:"members"`
+	}{RoomID: roomID, Members: members}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// createLink mints an invitation link to the room. Only the current members of the room can invite guests.
+func (rh *roomHandler) createGuestLink(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
+	roomID := chi.URLParam(r, "roomID")
+	roomType, ok := rh.hub.RoomOfMember(roomID, authUser.ID)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "You must be in the room to invite guests"}
+
+		sendResponse(w, http.StatusForbidden, errResp)
+		return
+	}
+
+	expiresAt := time.Now().Add(guestLinkTTL)
+	token, err := signToken(&JWTClaims{
+		UserID:   authUser.ID,
+		Scope:    ScopeGuestLink,
+		RoomID:   roomID,
+		RoomType: roomType,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expiresAt.Unix(),
+		},
+	})
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	resp := struct {
+		Token     string    `json:"token"`
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{
+		Token:     token,
+		URL:       fmt.Sprintf("%s/guest?token=%s", rh.appURL, url.QueryEscape(token)),
+		ExpiresAt: expiresAt,
+	}
+
+	sendResponse(w, http.StatusCreated, resp)
+}
@@ -1,23 +1,28 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/go-chi/chi"
 	chiware "github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	"github.com/gorilla/websocket"
 	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/blob"
+	"github.com/iamsayantan/talky/mail"
+	"github.com/iamsayantan/talky/metrics"
+	"github.com/iamsayantan/talky/ratelimit"
 	"github.com/iamsayantan/talky/store"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// Pinger checks a dependency of the server can be reached, *sql.DB is one.
+type Pinger interface {
+	Ping() error
 }
 
 type WebHandler interface {
@@ -25,11 +30,61 @@ type WebHandler interface {
 	Authenticate(handler http.Handler) http.Handler
 }
 
+// Config holds the dependencies and settings the server is built with.
+type Config struct {
+	UserRepo   store.UserRepository
+	TokenRepo  store.TokenRepository
+	APIKeyRepo store.APIKeyRepository
+	AuditRepo  store.AuditRepository
+	CallRepo   store.CallRepository
+	Mailer     mail.Mailer
+
+	// IdentityKeyRepo keeps the public identity keys the end-to-end encrypted rooms need, the users
+	// can't join those rooms when it is nil.
+	IdentityKeyRepo store.IdentityKeyRepository
+
+	// Auditor receives the security relevant events, nothing is recorded when it is nil.
+	Auditor talky.Auditor
+
+	// AvatarStorage is where the resized avatar images of the users are kept.
+	AvatarStorage blob.Storage
+
+	// AppURL is the base url of the web client, used to build the links sent in the emails.
+	AppURL string
+
+	// AllowedOrigins are the origins of the web pages which may call the api and open the websocket
+	// connections, like https://talky.example.com. "*" allows every origin, none is allowed when empty.
+	AllowedOrigins []string
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For and X-Real-IP headers are used for
+	// the address of the client. The headers of everyone else are ignored.
+	TrustedProxies []*net.IPNet
+
+	// DB is checked by the readiness probe, it is skipped when nil.
+	DB Pinger
+
+	// RateLimits limit the websocket messages of every user.
+	RateLimits talky.RateLimits
+
+	// SignallingPolicy checks the session descriptions and the ICE candidates relayed in the rooms.
+	SignallingPolicy talky.SignallingPolicy
+
+	// AuthRateLimit limits the registrations, logins and password reset requests from every client
+	// IP address.
+	AuthRateLimit ratelimit.Limit
+}
+
 type Server struct {
 	UserRepo store.UserRepository
 
-	hub    *talky.Hub
-	router chi.Router
+	hub      *talky.Hub
+	router   chi.Router
+	upgrader websocket.Upgrader
+	db       Pinger
+	draining int32 // draining is set once the shutdown started, no new websocket connections are accepted.
+
+	// identityKeyRepo gives the fingerprints of the identity keys of the connecting users.
+	identityKeyRepo store.IdentityKeyRepository
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -47,9 +102,19 @@ func (s *Server) ServeWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if atomic.LoadInt32(&s.draining) == 1 {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "server is shutting down"}
+
+		sendResponse(w, http.StatusServiceUnavailable, errResp)
+		return
+	}
+
 	log.Printf("Got Websocket Connection Request from User: %d", authUser.ID)
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		metrics.UpgradeFailures.Inc()
 		log.Printf("err: %v", err)
 		errResp := struct {
 			Error string `json:"error"`
@@ -58,42 +123,162 @@ func (s *Server) ServeWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := talky.NewClient(s.hub, authUser, conn)
-	s.hub.AddClient(client)
+	if s.identityKeyRepo != nil && !authUser.Guest {
+		// the fingerprint is taken when connecting, so a key changed later needs a new connection.
+		if key, err := s.identityKeyRepo.FindByUser(authUser.ID); err == nil {
+			user := *authUser
+			user.IdentityKey = key.Fingerprint
+			authUser = &user
+		}
+	}
+
+	talky.NewClient(s.hub, authUser, conn)
 }
 
-func NewServer(userRepo store.UserRepository) *Server {
+func NewServer(config Config) *Server {
 	s := &Server{
-		UserRepo: userRepo,
+		UserRepo:        config.UserRepo,
+		identityKeyRepo: config.IdentityKeyRepo,
+		db:              config.DB,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			Subprotocols:    talky.Subprotocols(),
+			CheckOrigin:     checkOrigin(config.AllowedOrigins),
+		},
+	}
+
+	if config.Auditor == nil {
+		config.Auditor = talky.NopAuditor{}
 	}
 
 	corsHandler := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
+		AllowOriginFunc: func(r *http.Request, origin string) bool {
+			return originAllowed(config.AllowedOrigins, origin)
+		},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 	})
 
 	r := chi.NewRouter()
-	r.Use(chiware.AllowContentType("application/json"))
+	r.Use(metrics.Middleware)
+	r.Use(realIP(config.TrustedProxies))
+	r.Use(chiware.AllowContentType("application/json", "multipart/form-data"))
 	r.Use(corsHandler.Handler)
 
-	h := NewUserHandler(s.UserRepo)
+	hubOpts := []talky.HubOption{
+		talky.WithAuditor(config.Auditor),
+		talky.WithRateLimits(config.RateLimits),
+		talky.WithSignallingPolicy(config.SignallingPolicy),
+	}
+	if config.CallRepo != nil {
+		hubOpts = append(hubOpts, talky.WithCallRecorder(config.CallRepo))
+	}
+
+	hub := talky.NewHub(hubOpts...)
+	metrics.SetHubSnapshot(hubSnapshot(hub))
+
+	r.Handle("/metrics", metrics.Handler())
+	r.Get("/healthz", s.healthz)
+	r.Get("/readyz", s.readyz)
+	throttle := NewLoginThrottle()
+	h := NewUserHandler(config, hub, throttle)
 	r.Route("/user", func(r chi.Router) {
 		r.Mount("/v1", h.Route())
 	})
 
-	r.Group(func(r chi.Router) {
+	r.Get("/avatars/{userID}/{version}", serveAvatar(config.AvatarStorage))
+
+	ah := newAdminHandler(config, hub, throttle)
+	r.Route("/admin", func(r chi.Router) {
 		r.Use(h.Authenticate)
-		r.Get("/ws", s.ServeWs)
+		r.Mount("/v1", ah.Route())
+	})
+
+	rh := newRoomHandler(hub, config.AppURL, h.Authenticate)
+	r.Route("/rooms", func(r chi.Router) {
+		r.Mount("/v1", rh.Route())
+	})
+
+	ch := newCallHandler(config)
+	r.Route("/calls", func(r chi.Router) {
+		r.Use(h.Authenticate)
+		r.Mount("/v1", ch.Route())
+	})
+
+	gh := newGuestHandler()
+	r.Route("/guest", func(r chi.Router) {
+		r.Mount("/v1", gh.Route())
+	})
+
+	th := newTicketHandler()
+	r.Group(func(r chi.Router) {
+		r.Use(allowScope(talky.ScopeJoinRoom))
+		r.Use(gh.authenticateWs(h))
+		r.Post("/ws/ticket", th.issue)
 	})
 
-	hub := talky.NewHub()
+	r.Group(func(r chi.Router) {
+		// the tickets are only issued to the api keys with the scope, so they need no check of their own.
+		r.Use(allowScope(talky.ScopeJoinRoom))
+		r.Use(th.authenticate(gh.authenticateWs(h)))
+		r.Get("/ws", s.ServeWs)
+	})
 
 	s.router = r
 	s.hub = hub
 	return s
 }
 
+// checkOrigin only lets the allowed origins open websocket connections. Browsers always send the
+// origin of the page, the requests without one come from other kinds of clients, like the bots.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || originAllowed(allowed, origin) {
+			return true
+		}
+
+		log.Printf("Rejected websocket connection from origin %s", origin)
+		return false
+	}
+}
+
+// originAllowed reports if the origin is one of the allowed ones, no origin is allowed when the
+// list is empty.
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hubSnapshot reads the gauges of the hub for the metrics.
+func hubSnapshot(hub *talky.Hub) func(ctx context.Context) (metrics.HubSnapshot, error) {
+	return func(ctx context.Context) (metrics.HubSnapshot, error) {
+		stats, err := hub.StatsContext(ctx)
+		if err != nil {
+			return metrics.HubSnapshot{}, err
+		}
+
+		snapshot := metrics.HubSnapshot{
+			ConnectedClients: stats.ConnectedClients,
+			RoomsByType:      map[string]int{string(talky.AudioRoom): 0, string(talky.AudioVideoRoom): 0},
+			RoomMembers:      stats.RoomMembers,
+			QueuedMessages:   stats.QueuedMessages,
+		}
+
+		for roomType, count := range stats.RoomsByType {
+			snapshot.RoomsByType[string(roomType)] = count
+		}
+
+		return snapshot, nil
+	}
+}
+
 func sendResponse(w http.ResponseWriter, statusCode int, v interface{}) {
 	w.WriteHeader(statusCode)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// accountFreeAttempts is the number of failed logins allowed for an account before
+	// we start locking it out.
+	accountFreeAttempts = 3
+
+	// ipFreeAttempts is the number of failed logins allowed from a single IP address before
+	// we start locking it out. This is higher than the account limit because many users
+	// can share an address behind a NAT.
+	ipFreeAttempts = 20
+
+	// baseLockout is the lockout applied on the first failure past the free attempts, it
+	// doubles with every further failure.
+	baseLockout = 1 * time.Second
+
+	// maxLockout caps the exponential backoff.
+	maxLockout = 15 * time.Minute
+
+	// attemptWindow is how long failures are remembered after the last failed attempt.
+	attemptWindow = 1 * time.Hour
+)
+
+// loginAttempts tracks the failed login attempts for a single account or IP address.
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// LoginThrottle keeps track of failed login attempts per account and per IP address and
+// locks them out with an exponential backoff. The state is kept in memory, so it is reset
+// whenever the server restarts.
+type LoginThrottle struct {
+	accounts map[string]*loginAttempts
+	ips      map[string]*loginAttempts
+
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+// NewLoginThrottle creates an empty LoginThrottle.
+func NewLoginThrottle() *LoginThrottle {
+	return &LoginThrottle{
+		accounts:  make(map[string]*loginAttempts),
+		ips:       make(map[string]*loginAttempts),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow checks if a login attempt for the username from the ip is allowed right now. If it is
+// not, it returns how long the caller has to wait before trying again.
+func (t *LoginThrottle) Allow(username, ip string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+
+	var wait time.Duration
+	if a, ok := t.accounts[accountKey(username)]; ok && a.lockedUntil.After(now) {
+		wait = a.lockedUntil.Sub(now)
+	}
+
+	if a, ok := t.ips[ip]; ok && a.lockedUntil.After(now) && a.lockedUntil.Sub(now) > wait {
+		wait = a.lockedUntil.Sub(now)
+	}
+
+	return wait == 0, wait
+}
+
+// Failure records a failed login attempt for the username from the ip.
+func (t *LoginThrottle) Failure(username, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	record(t.accounts, accountKey(username), accountFreeAttempts, now)
+	record(t.ips, ip, ipFreeAttempts, now)
+}
+
+// Success clears the failed attempts of the username after a successful login. The IP address
+// is left alone, one good password should not reset the counter for someone guessing many
+// accounts from the same address.
+func (t *LoginThrottle) Success(username string) {
+	t.Unlock(username)
+}
+
+// Unlock removes any lockout and failure history of the username.
+func (t *LoginThrottle) Unlock(username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.accounts, accountKey(username))
+}
+
+// Locked reports if the username is currently locked out.
+func (t *LoginThrottle) Locked(username string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	a, ok := t.accounts[accountKey(username)]
+	return ok && a.lockedUntil.After(time.Now())
+}
+
+// sweep drops the entries which have not seen a failure in the attempt window, so the maps
+// don't grow forever. It runs at most once per window.
+func (t *LoginThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < attemptWindow {
+		return
+	}
+
+	for _, m := range []map[string]*loginAttempts{t.accounts, t.ips} {
+		for key, a := range m {
+			if now.Sub(a.lastFailure) > attemptWindow && !a.lockedUntil.After(now) {
+				delete(m, key)
+			}
+		}
+	}
+
+	t.lastSweep = now
+}
+
+func record(m map[string]*loginAttempts, key string, freeAttempts int, now time.Time) {
+	a, ok := m[key]
+	if !ok || now.Sub(a.lastFailure) > attemptWindow {
+		a = &loginAttempts{}
+		m[key] = a
+	}
+
+	a.failures++
+	a.lastFailure = now
+
+	if a.failures <= freeAttempts {
+		return
+	}
+
+	lockout := maxLockout
+	if shift := uint(a.failures - freeAttempts - 1); shift < 20 {
+		if d := baseLockout << shift; d < maxLockout {
+			lockout = d
+		}
+	}
+
+	a.lockedUntil = now.Add(lockout)
+}
+
+// accountKey normalizes the username so that the lockout can't be bypassed by changing the case.
+func accountKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// clientIP returns the IP address of the client without the port. The realIP middleware already
+// replaced the RemoteAddr with the forwarded address when the request came from a trusted proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"github.com/iamsayantan/talky"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// TicketQueryParam is the query parameter the websocket ticket is sent in. Browsers can't set
+	// headers on websocket connections, so the web client exchanges its access token for a ticket.
+	TicketQueryParam = "ticket"
+
+	// wsTicketTTL is how long a websocket ticket can be used.
+	wsTicketTTL = 30 * time.Second
+)
+
+// wsTicket is the user a websocket ticket was issued to.
+type wsTicket struct {
+	user      *talky.User
+	expiresAt time.Time
+}
+
+// ticketStore keeps the short lived, single use websocket tickets. The tickets only make sense to
+// the server which issued them, so the client has to get a new one every time it connects.
+type ticketStore struct {
+	mu      sync.Mutex
+	tickets map[string]wsTicket
+	ttl     time.Duration
+}
+
+func newTicketStore(ttl time.Duration) *ticketStore {
+	return &ticketStore{
+		tickets: make(map[string]wsTicket),
+		ttl:     ttl,
+	}
+}
+
+// issue creates a ticket for the user, only the hash of the ticket is kept.
+func (ts *ticketStore) issue(user *talky.User) (string, time.Time, error) {
+	ticket, err := talky.RandomToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ts.ttl)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	// the tickets are used right after they are issued, so dropping the expired ones here keeps the
+	// store small without a sweeper goroutine.
+	for hash, t := range ts.tickets {
+		if now.After(t.expiresAt) {
+			delete(ts.tickets, hash)
+		}
+	}
+
+	ts.tickets[talky.HashToken(ticket)] = wsTicket{user: user, expiresAt: expiresAt}
+	return ticket, expiresAt, nil
+}
+
+// redeem returns the user of the ticket and forgets the ticket, so it can't be used again.
+func (ts *ticketStore) redeem(ticket string) (*talky.User, bool) {
+	hash := talky.HashToken(ticket)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.tickets[hash]
+	if !ok {
+		return nil, false
+	}
+
+	delete(ts.tickets, hash)
+	if time.Now().After(t.expiresAt) {
+		return nil, false
+	}
+
+	return t.user, true
+}
+
+// ticketHandler exchanges the access tokens for websocket tickets, so the long lived tokens never
+// end up in the urls, and with them in the logs of every proxy on the way.
+type ticketHandler struct {
+	tickets *ticketStore
+}
+
+func newTicketHandler() *ticketHandler {
+	return &ticketHandler{tickets: newTicketStore(wsTicketTTL)}
+}
+
+// issue gives the authenticated user a ticket for their next websocket connection.
+func (th *ticketHandler) issue(w http.ResponseWriter, r *http.Request) {
+	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
+	if !ok {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Invalid access token"}
+
+		sendResponse(w, http.StatusUnauthorized, errResp)
+		return
+	}
+
+	ticket, expiresAt, err := th.tickets.issue(authUser)
+	if err != nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}
+
+		sendResponse(w, http.StatusInternalServerError, errResp)
+		return
+	}
+
+	resp := struct {
+		Ticket    string    `json:"ticket"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{Ticket: ticket, ExpiresAt: expiresAt}
+
+	sendResponse(w, http.StatusOK, resp)
+}
+
+// authenticate is the authentication middleware of the websocket route. The connections with a
+// ticket are authenticated by it, the others fall back to the tokens in the headers.
+func (th *ticketHandler) authenticate(fallback func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withToken := fallback(next)
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ticket := r.URL.Query().Get(TicketQueryParam)
+			if ticket == "" {
+				withToken.ServeHTTP(w, r)
+				return
+			}
+
+			user, ok := th.tickets.redeem(ticket)
+			if !ok {
+				errResp := struct {
+					Error string `json:"error"`
+				}{Error: "invalid or expired ticket"}
+
+				sendResponse(w, http.StatusUnauthorized, errResp)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), KeyAuthUser, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
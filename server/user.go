@@ -7,9 +7,17 @@ import (
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/blob"
+	"github.com/iamsayantan/talky/mail"
+	"github.com/iamsayantan/talky/metrics"
+	"github.com/iamsayantan/talky/ratelimit"
 	"github.com/iamsayantan/talky/store"
 	"golang.org/x/crypto/bcrypt"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,19 +28,47 @@ const (
 	// KeyAuthUser holds the currently authenticatd user to context.
 	KeyAuthUser contextKey = 0
 
+	// keyAllowedScope holds the api key scope the route allows, see allowScope.
+	keyAllowedScope contextKey = 1
+
 	// AuthorizationHeader is the key from where we extract the authentication token.
 	AuthorizationHeader = "Authorization"
 
-	// AuthorizationQueryParam is the key from where we extract the auth token when supplied as query string parameter.
+	// AuthorizationQueryParam is the query string parameter the auth token used to be accepted in. The
+	// requests still sending it are turned down.
 	AuthorizationQueryParam = "auth_token"
+
+	// APIKeyHeader can be used by the bots to send their api key, the authorization header works as well.
+	APIKeyHeader = "X-API-Key"
+
+	// apiKeyTouchInterval is how often the last use time of an api key is updated.
+	apiKeyTouchInterval = time.Minute
 )
 
 // JwtSigningSecret used for signing and verifying jwt tokens.
 const JwtSigningSecret = "secret"
 
+// ErrInvalidCredentials is returned for a failed login, whether the username or the password was wrong.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ErrAccountDisabled is returned when a disabled user tries to login or use their access token.
+var ErrAccountDisabled = errors.New("account disabled")
+
+// dummyPasswordHash is compared against when the user trying to login does not exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("talky-dummy-password"), bcrypt.DefaultCost)
+
 // JWTClaims represents the JWT token payload
 type JWTClaims struct {
 	UserID uint `json:"user_id"`
+
+	// Scope limits what the token can be used for, it is empty for the normal access tokens.
+	Scope       string         `json:"scope,omitempty"`
+	RoomID      string         `json:"room_id,omitempty"`
+	RoomType    talky.RoomType `json:"room_type,omitempty"`
+	DisplayName string         `json:"display_name,omitempty"`
+
+	// TokenVersion is the token version of the user when the token was issued.
+	TokenVersion uint `json:"token_version,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -45,24 +81,79 @@ type registerRequest struct {
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Username  string `json:"username"`
+	Email     string `json:"email"`
 	Password  string `json:"password"`
 }
 
+// account is the user as seen by themselves. Along with the public user fields it also
+// contains the private ones.
+type account struct {
+	*talky.User
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func newAccount(user *talky.User) *account {
+	return &account{User: user, Email: user.Email, EmailVerified: user.EmailVerified}
+}
+
 type userHandler struct {
-	userRepo store.UserRepository
+	userRepo   store.UserRepository
+	tokenRepo  store.TokenRepository
+	apiKeyRepo store.APIKeyRepository
+	mailer     mail.Mailer
+	appURL     string
+	avatars    blob.Storage
+	hub        *talky.Hub
+	throttle   *LoginThrottle
+	auditor    talky.Auditor
+
+	// identityKeyRepo keeps the public identity keys of the users, the identity key routes are not
+	// served when it is nil.
+	identityKeyRepo store.IdentityKeyRepository
+
+	// authLimiter limits the registrations, logins and password reset requests per client IP
+	// address, on top of the lockout of the accounts.
+	authLimiter *ratelimit.Limiter
 }
 
-func NewUserHandler(repo store.UserRepository) WebHandler {
-	return &userHandler{userRepo: repo}
+func NewUserHandler(config Config, hub *talky.Hub, throttle *LoginThrottle) WebHandler {
+	return &userHandler{
+		userRepo:   config.UserRepo,
+		tokenRepo:  config.TokenRepo,
+		apiKeyRepo: config.APIKeyRepo,
+		mailer:     config.Mailer,
+		appURL:     strings.TrimRight(config.AppURL, "/"),
+		avatars:    config.AvatarStorage,
+		hub:        hub,
+		throttle:   throttle,
+		auditor:    config.Auditor,
+
+		identityKeyRepo: config.IdentityKeyRepo,
+		authLimiter:     ratelimit.NewLimiter(config.AuthRateLimit),
+	}
 }
 
 func (uh *userHandler) Route() chi.Router {
 	r := chi.NewRouter()
-	r.Post("/register", uh.register)
-	r.Post("/login", uh.login)
+	r.With(rateLimit(uh.authLimiter)).Post("/register", uh.register)
+	r.With(rateLimit(uh.authLimiter)).Post("/login", uh.login)
+	r.Post("/email/verify", uh.verifyEmail)
+	r.With(rateLimit(uh.authLimiter)).Post("/password/forgot", uh.forgotPassword)
+	r.Post("/password/reset", uh.resetPassword)
 	r.Group(func(r chi.Router) {
 		r.Use(uh.authenticate)
 		r.Get("/me", uh.me)
+		r.Put("/me", uh.updateProfile)
+		r.Post("/me/password", uh.changePassword)
+		r.Delete("/me", uh.deleteAccount)
+		r.Put("/me/avatar", uh.uploadAvatar)
+		r.Delete("/me/avatar", uh.removeAvatar)
+		r.Post("/email/resend", uh.resendVerification)
+
+		if uh.identityKeyRepo != nil {
+			uh.identityKeyRoutes(r)
+		}
 	})
 
 	return r
@@ -85,7 +176,9 @@ func (uh *userHandler) register(w http.ResponseWriter, r *http.Request) {
 		FirstName: registrationReq.FirstName,
 		LastName:  registrationReq.LastName,
 		Username:  registrationReq.Username,
+		Email:     strings.TrimSpace(registrationReq.Email),
 		Password:  registrationReq.Password,
+		Role:      talky.RoleUser,
 	}
 
 	if err := user.IsValid(); err != nil {
@@ -106,6 +199,16 @@ func (uh *userHandler) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, err = uh.userRepo.FindByEmail(user.Email)
+	if err == nil {
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Email already registered"}
+
+		sendResponse(w, http.StatusBadRequest, errResp)
+		return
+	}
+
 	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(registrationReq.Password), bcrypt.DefaultCost)
 	if err := user.IsValid(); err != nil {
 		errResp := struct {
@@ -137,10 +240,16 @@ func (uh *userHandler) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	uh.sendVerificationEmail(user)
+
+	event := auditEvent(r, talky.AuditRegister)
+	event.ActorID, event.ActorName = user.ID, user.Username
+	uh.auditor.Record(event)
+
 	resp := struct {
-		User        *talky.User `json:"user"`
-		AccessToken string      `json:"access_token"`
-	}{User: user, AccessToken: token}
+		User        *account `json:"user"`
+		AccessToken string   `json:"access_token"`
+	}{User: newAccount(user), AccessToken: token}
 
 	sendResponse(w, http.StatusCreated, resp)
 }
@@ -167,22 +276,49 @@ func (uh *userHandler) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	if ok, wait := uh.throttle.Allow(loginReq.Username, ip); !ok {
+		uh.recordLogin(r, talky.AuditLoginFailure, loginReq.Username, nil, "locked out")
+
+		errResp := struct {
+			Error string `json:"error"`
+		}{Error: "Too many failed login attempts, try again later"}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		sendResponse(w, http.StatusTooManyRequests, errResp)
+		return
+	}
+
+	// Unknown usernames and wrong passwords get the same response, and we still run bcrypt
+	// against a dummy hash when the user does not exist so the timing doesn't tell them apart.
+	passwordHash := dummyPasswordHash
 	user, err := uh.userRepo.FindByUsername(loginReq.Username)
-	if err != nil {
+	if err == nil {
+		passwordHash = []byte(user.Password)
+	}
+
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(loginReq.Password)) != nil || err != nil {
+		uh.throttle.Failure(loginReq.Username, ip)
+		uh.recordLogin(r, talky.AuditLoginFailure, loginReq.Username, user, "invalid credentials")
+
 		errResp := struct {
 			Error string `json:"error"`
-		}{Error: err.Error()}
+		}{Error: ErrInvalidCredentials.Error()}
 
 		sendResponse(w, http.StatusBadRequest, errResp)
 		return
 	}
 
-	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password)); err != nil {
+	uh.throttle.Success(loginReq.Username)
+
+	if user.Disabled {
+		uh.recordLogin(r, talky.AuditLoginFailure, loginReq.Username, user, "account disabled")
+
 		errResp := struct {
 			Error string `json:"error"`
-		}{Error: "invalid password"}
+		}{Error: ErrAccountDisabled.Error()}
 
-		sendResponse(w, http.StatusBadRequest, errResp)
+		sendResponse(w, http.StatusForbidden, errResp)
 		return
 	}
 
@@ -196,14 +332,35 @@ func (uh *userHandler) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	uh.recordLogin(r, talky.AuditLoginSuccess, loginReq.Username, user, "")
+
 	resp := struct {
-		User        *talky.User `json:"user"`
-		AccessToken string      `json:"access_token"`
-	}{User: user, AccessToken: accessToken}
+		User        *account `json:"user"`
+		AccessToken string   `json:"access_token"`
+	}{User: newAccount(user), AccessToken: accessToken}
 
 	sendResponse(w, http.StatusOK, resp)
 }
 
+// recordLogin records a login attempt in the audit log and the metrics. The user is nil when
+// the username does not exist.
+func (uh *userHandler) recordLogin(r *http.Request, action talky.AuditAction, username string, user *talky.User, detail string) {
+	if action == talky.AuditLoginSuccess {
+		metrics.Logins.WithLabelValues("success").Inc()
+	} else {
+		metrics.Logins.WithLabelValues("failure").Inc()
+	}
+
+	event := auditEvent(r, action)
+	event.ActorName = username
+	event.Detail = detail
+	if user != nil {
+		event.ActorID = user.ID
+	}
+
+	uh.auditor.Record(event)
+}
+
 func (uh *userHandler) me(w http.ResponseWriter, r *http.Request) {
 	authUser, ok := r.Context().Value(KeyAuthUser).(*talky.User)
 	if !ok {
@@ -216,28 +373,98 @@ func (uh *userHandler) me(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := struct {
-		User *talky.User `json:"user"`
-	}{User: authUser}
+		User *account `json:"user"`
+	}{User: newAccount(authUser)}
 
 	sendResponse(w, http.StatusOK, resp)
 }
 
 func (uh *userHandler) generateAuthToken(user *talky.User) (string, error) {
-	jwtKey := []byte(JwtSigningSecret)
 	expirationTime := time.Now().Add(time.Hour * 24 * 365) // valid for one year
 
 	claims := &JWTClaims{
-		UserID: user.ID,
+		UserID:       user.ID,
+		TokenVersion: user.TokenVersion,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expirationTime.Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	return signToken(claims)
 }
 
 func (uh *userHandler) verifyAuthToken(token string) (*talky.User, error) {
+	if strings.HasPrefix(token, talky.APIKeyPrefix) {
+		return uh.verifyAPIKey(token)
+	}
+
+	claims, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// scoped tokens, like the guest tokens, are only accepted by the routes which ask for them.
+	if claims.Scope != "" {
+		return nil, errors.New("invalid access token")
+	}
+
+	user, err := uh.userRepo.FindById(claims.UserID)
+	if err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	// the tokens issued before the password was changed are revoked.
+	if claims.TokenVersion != user.TokenVersion {
+		return nil, errors.New("invalid access token")
+	}
+
+	return user, nil
+}
+
+// verifyAPIKey authenticates a bot with its api key. The returned user is limited to the scopes of the key.
+func (uh *userHandler) verifyAPIKey(plain string) (*talky.User, error) {
+	prefix, ok := talky.APIKeyPrefixOf(plain)
+	if !ok {
+		return nil, errors.New("invalid api key")
+	}
+
+	key, err := uh.apiKeyRepo.FindByPrefix(prefix)
+	if err != nil || !key.Matches(plain) || key.IsRevoked() {
+		return nil, errors.New("invalid api key")
+	}
+
+	user, err := uh.userRepo.FindById(key.UserID)
+	if err != nil || !user.Bot {
+		return nil, errors.New("invalid api key")
+	}
+
+	if user.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	// we don't need the exact time, so the database is only written once in a while.
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > apiKeyTouchInterval {
+		if err := uh.apiKeyRepo.TouchLastUsed(key.ID); err != nil {
+			log.Printf("Error updating last use of api key %d: %v", key.ID, err)
+		}
+	}
+
+	user.Scopes = key.Scopes()
+	return user, nil
+}
+
+// signToken signs the claims into a jwt token.
+func signToken(claims *JWTClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(JwtSigningSecret))
+}
+
+// parseToken verifies the jwt token and returns its claims.
+func parseToken(token string) (*JWTClaims, error) {
 	jwtKey := []byte(JwtSigningSecret)
 
 	claims := &JWTClaims{}
@@ -253,12 +480,7 @@ func (uh *userHandler) verifyAuthToken(token string) (*talky.User, error) {
 		return nil, errors.New("invalid access token")
 	}
 
-	user, err := uh.userRepo.FindById(claims.UserID)
-	if err != nil {
-		return nil, errors.New("user not found")
-	}
-
-	return user, nil
+	return claims, nil
 }
 
 // Authenticate public interface for the authenticate middleware.
@@ -268,13 +490,22 @@ func (uh *userHandler) Authenticate(next http.Handler) http.Handler {
 
 func (uh *userHandler) authenticate(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
+		// the urls end up in the logs of every proxy on the way, so the tokens must be sent in the
+		// headers. the websocket connections use a ticket instead.
+		if r.URL.Query().Get(AuthorizationQueryParam) != "" {
+			errResp := struct {
+				Error string `json:"error"`
+			}{Error: "access tokens are not accepted in the query string"}
+
+			sendResponse(w, http.StatusUnauthorized, errResp)
+			return
+		}
+
 		token := r.Header.Get(AuthorizationHeader)
 		ctx := r.Context()
 
 		if token == "" {
-			// If the auth token is not present in the authorization header we will attempt to fetch it from the
-			// query parameter.
-			token = r.URL.Query().Get(AuthorizationQueryParam)
+			token = r.Header.Get(APIKeyHeader)
 		}
 
 		if token == "" {
@@ -297,6 +528,16 @@ func (uh *userHandler) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// the api keys are turned down unless the route allows one of their scopes.
+		if scope, _ := ctx.Value(keyAllowedScope).(string); user.Scopes != nil && (scope == "" || !user.HasScope(scope)) {
+			errResp := struct {
+				Error string `json:"error"`
+			}{Error: talky.ErrMissingScope.Error()}
+
+			sendResponse(w, http.StatusForbidden, errResp)
+			return
+		}
+
 		ctx = context.WithValue(ctx, KeyAuthUser, user)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/mail"
+	"github.com/iamsayantan/talky/ratelimit"
+	"github.com/iamsayantan/talky/store"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUserRepo keeps the users in memory. The methods the tests don't need are left to the
+// embedded interface, they panic when called.
+type fakeUserRepo struct {
+	store.UserRepository
+	users map[uint]*talky.User
+}
+
+func (f *fakeUserRepo) FindById(id uint) (*talky.User, error) {
+	user, ok := f.users[id]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+
+	u := *user
+	return &u, nil
+}
+
+func (f *fakeUserRepo) UpdatePassword(id uint, passwordHash string) error {
+	user, ok := f.users[id]
+	if !ok {
+		return errors.New("record not found")
+	}
+
+	user.Password = passwordHash
+	user.TokenVersion++
+	return nil
+}
+
+func (f *fakeUserRepo) FindByEmail(email string) (*talky.User, error) {
+	for _, user := range f.users {
+		if strings.EqualFold(user.Email, email) {
+			u := *user
+			return &u, nil
+		}
+	}
+
+	return nil, errors.New("record not found")
+}
+
+func (f *fakeUserRepo) UpdateName(id uint, firstName, lastName string) error {
+	f.users[id].FirstName, f.users[id].LastName = firstName, lastName
+	return nil
+}
+
+func (f *fakeUserRepo) UpdateEmail(id uint, email string) error {
+	f.users[id].Email, f.users[id].EmailVerified = email, false
+	return nil
+}
+
+func (f *fakeUserRepo) MarkEmailVerified(id uint) error {
+	f.users[id].EmailVerified = true
+	return nil
+}
+
+// fakeTokenRepo keeps the user tokens in memory, by their hash.
+type fakeTokenRepo struct {
+	tokens map[string]*talky.UserToken
+}
+
+func (f *fakeTokenRepo) CreateToken(token *talky.UserToken) (*talky.UserToken, error) {
+	f.tokens[token.TokenHash] = token
+	return token, nil
+}
+
+func (f *fakeTokenRepo) ConsumeToken(hash string, purpose talky.TokenPurpose) (*talky.UserToken, error) {
+	token, ok := f.tokens[hash]
+	if !ok || token.Purpose != purpose || !token.IsUsable() {
+		return nil, talky.ErrInvalidToken
+	}
+
+	now := time.Now()
+	token.UsedAt = &now
+	return token, nil
+}
+
+func (f *fakeTokenRepo) DeleteUserTokens(userID uint, purpose talky.TokenPurpose) error {
+	for hash, token := range f.tokens {
+		if token.UserID == userID && token.Purpose == purpose {
+			delete(f.tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+// fakeMailer hands the sent messages to the test.
+type fakeMailer chan mail.Message
+
+func (f fakeMailer) Send(msg mail.Message) error {
+	f <- msg
+	return nil
+}
+
+// linkToken reads the token from the link in the mail.
+var linkToken = regexp.MustCompile(`token=([\w-]+)`)
+
+// fakeAPIKeyRepo keeps the api keys in memory, by their prefix.
+type fakeAPIKeyRepo struct {
+	store.APIKeyRepository
+	keys map[string]*talky.APIKey
+}
+
+func (f *fakeAPIKeyRepo) FindByPrefix(prefix string) (*talky.APIKey, error) {
+	key, ok := f.keys[prefix]
+	if !ok {
+		return nil, errors.New("record not found")
+	}
+
+	return key, nil
+}
+
+func (f *fakeAPIKeyRepo) TouchLastUsed(id uint) error {
+	return nil
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	users := &fakeUserRepo{users: map[uint]*talky.User{
+		1: {ID: 1, Username: "alice", Role: talky.RoleUser},
+		2: {ID: 2, Username: "bot", Role: talky.RoleAdmin, Bot: true},
+	}}
+	keys := &fakeAPIKeyRepo{keys: map[string]*talky.APIKey{}}
+
+	newKey := func(scopes ...string) string {
+		key, plain, err := talky.NewAPIKey(2, "test", scopes)
+		if err != nil {
+			t.Fatalf("NewAPIKey: %v", err)
+		}
+
+		keys.keys[key.Prefix] = key
+		return plain
+	}
+
+	presence := newKey(talky.ScopeReadPresence)
+	join := newKey(talky.ScopeJoinRoom)
+
+	token, err := (&userHandler{}).generateAuthToken(users.users[1])
+	if err != nil {
+		t.Fatalf("generateAuthToken: %v", err)
+	}
+
+	s := NewServer(Config{UserRepo: users, APIKeyRepo: keys})
+
+	tests := []struct {
+		credential string
+		method     string
+		path       string
+		status     int
+	}{
+		// the routes which don't allow a scope turn down every api key, whatever its scopes.
+		{presence, "GET", "/user/v1/me", http.StatusForbidden},
+		{presence, "PUT", "/user/v1/me", http.StatusForbidden},
+		{presence, "DELETE", "/user/v1/me", http.StatusForbidden},
+		{presence, "DELETE", "/user/v1/me/avatar", http.StatusForbidden},
+		{presence, "GET", "/calls/v1/", http.StatusForbidden},
+		{presence, "POST", "/rooms/v1/room/guest-links", http.StatusForbidden},
+		{presence, "GET", "/admin/v1/stats", http.StatusForbidden},
+		{join, "GET", "/admin/v1/stats", http.StatusForbidden},
+
+		// the routes which allow a scope only take the keys with it.
+		{presence, "GET", "/rooms/v1/room/members", http.StatusNotFound},
+		{join, "GET", "/rooms/v1/room/members", http.StatusForbidden},
+		{presence, "POST", "/ws/ticket", http.StatusForbidden},
+		{join, "POST", "/ws/ticket", http.StatusOK},
+
+		// the users who logged in are not limited by scopes.
+		{token, "GET", "/user/v1/me", http.StatusOK},
+		{token, "POST", "/ws/ticket", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set(AuthorizationHeader, tt.credential)
+		w := httptest.NewRecorder()
+
+		s.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with %.8s got %d, want %d: %s", tt.method, tt.path, tt.credential, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestEmailChangeRevokesVerificationLinks(t *testing.T) {
+	users := &fakeUserRepo{users: map[uint]*talky.User{1: {ID: 1, FirstName: "Alice", LastName: "Smith", Username: "alice", Email: "alice@example.com", Password: "hash"}}}
+	tokens := &fakeTokenRepo{tokens: map[string]*talky.UserToken{}}
+	mailer := make(fakeMailer, 1)
+	uh := &userHandler{userRepo: users, tokenRepo: tokens, mailer: mailer}
+
+	do := func(handler http.HandlerFunc, body string) int {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		user, _ := users.FindById(1)
+		r = r.WithContext(context.WithValue(r.Context(), KeyAuthUser, user))
+		w := httptest.NewRecorder()
+
+		handler(w, r)
+		return w.Code
+	}
+
+	old, err := uh.createTokenLink(users.users[1], talky.TokenEmailVerification, emailVerificationTTL, "/verify-email")
+	if err != nil {
+		t.Fatalf("createTokenLink: %v", err)
+	}
+
+	if code := do(uh.updateProfile, `{"first_name": "Alice", "last_name": "Smith", "email": "mallory@example.com"}`); code != http.StatusOK {
+		t.Fatalf("updateProfile got %d", code)
+	}
+
+	var fresh string
+	select {
+	case msg := <-mailer:
+		fresh = linkToken.FindStringSubmatch(msg.Body)[1]
+	case <-time.After(5 * time.Second):
+		t.Fatal("no verification mail was sent to the new address")
+	}
+
+	if code := do(uh.verifyEmail, `{"token": "`+linkToken.FindStringSubmatch(old)[1]+`"}`); code != http.StatusBadRequest {
+		t.Errorf("the link sent to the old address got %d, want %d", code, http.StatusBadRequest)
+	}
+
+	if users.users[1].EmailVerified {
+		t.Fatal("the link sent to the old address verified the new one")
+	}
+
+	if code := do(uh.verifyEmail, `{"token": "`+fresh+`"}`); code != http.StatusOK || !users.users[1].EmailVerified {
+		t.Errorf("the link sent to the new address got %d", code)
+	}
+}
+
+func TestForgotPassword(t *testing.T) {
+	users := &fakeUserRepo{users: map[uint]*talky.User{1: {ID: 1, FirstName: "Alice", Username: "alice", Email: "alice@example.com"}}}
+	mailer := make(fakeMailer, 1)
+	uh := &userHandler{
+		userRepo:    users,
+		tokenRepo:   &fakeTokenRepo{tokens: map[string]*talky.UserToken{}},
+		mailer:      mailer,
+		authLimiter: ratelimit.NewLimiter(ratelimit.Limit{Rate: 0.001, Burst: 2}),
+	}
+	router := uh.Route()
+
+	forgot := func(email string) int {
+		r := httptest.NewRequest("POST", "/password/forgot", strings.NewReader(`{"email": "`+email+`"}`))
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, email := range []string{"nobody@example.com", "alice@example.com"} {
+		if code := forgot(email); code != http.StatusAccepted {
+			t.Errorf("forgot password of %s got %d, want %d", email, code, http.StatusAccepted)
+		}
+	}
+
+	select {
+	case msg := <-mailer:
+		if msg.To != "alice@example.com" || !linkToken.MatchString(msg.Body) {
+			t.Errorf("reset mail to %s without a link:\n%s", msg.To, msg.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset mail was sent")
+	}
+
+	// the client has used up its requests, nobody gets mailed anymore.
+	if code := forgot("alice@example.com"); code != http.StatusTooManyRequests {
+		t.Errorf("forgot password over the limit got %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestVerifyAuthTokenRevokedByPasswordChange(t *testing.T) {
+	repo := &fakeUserRepo{users: map[uint]*talky.User{1: {ID: 1, Username: "alice"}}}
+	uh := &userHandler{userRepo: repo}
+
+	old, err := uh.generateAuthToken(repo.users[1])
+	if err != nil {
+		t.Fatalf("generateAuthToken: %v", err)
+	}
+
+	if _, err := uh.verifyAuthToken(old); err != nil {
+		t.Fatalf("verifyAuthToken rejected a fresh token: %v", err)
+	}
+
+	if err := repo.UpdatePassword(1, "new-hash"); err != nil {
+		t.Fatalf("UpdatePassword: %v", err)
+	}
+
+	if _, err := uh.verifyAuthToken(old); err == nil {
+		t.Error("verifyAuthToken accepted a token issued before the password change")
+	}
+
+	fresh, err := uh.generateAuthToken(repo.users[1])
+	if err != nil {
+		t.Fatalf("generateAuthToken: %v", err)
+	}
+
+	if _, err := uh.verifyAuthToken(fresh); err != nil {
+		t.Errorf("verifyAuthToken rejected a token issued after the password change: %v", err)
+	}
+}
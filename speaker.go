@@ -0,0 +1,118 @@
+package talky
+
+import "time"
+
+// The settings of the dominant speaker detection of the rooms.
+const (
+	// speakerSmoothing is the weight of a new audio level sample in the smoothed level of a member.
+	speakerSmoothing = 0.3
+
+	// speakerThreshold is the smoothed level below which a member is taken to be silent.
+	speakerThreshold = 0.05
+
+	// speakerHysteresis is how many times louder than the dominant speaker another member has to be
+	// to take over, so the speaker doesn't flip between members talking over each other.
+	speakerHysteresis = 1.5
+
+	// speakerHoldTime is how long the dominant speaker stays at least, whoever gets louder.
+	speakerHoldTime = 1500 * time.Millisecond
+
+	// speakerLevelTTL is how long an audio level counts without a new sample, the members who
+	// stopped reporting are taken to be silent after it.
+	speakerLevelTTL = 2 * time.Second
+)
+
+type speakerLevel struct {
+	smoothed  float64
+	updatedAt time.Time
+}
+
+// speakerDetector picks the dominant speaker of a room from the audio levels of the members. It
+// belongs to the goroutine of its room.
+type speakerDetector struct {
+	levels   map[uint]*speakerLevel
+	dominant uint      // dominant is the current dominant speaker, zero before anyone spoke.
+	since    time.Time // since is when the dominant speaker took over.
+}
+
+// add folds the audio level sample of the member into their smoothed level. It returns the dominant
+// speaker and reports if they changed.
+func (d *speakerDetector) add(userID uint, level float64, now time.Time) (uint, bool) {
+	if d.levels == nil {
+		d.levels = make(map[uint]*speakerLevel)
+	}
+
+	l, ok := d.levels[userID]
+	if !ok || now.Sub(l.updatedAt) > speakerLevelTTL {
+		l = &speakerLevel{smoothed: level}
+		d.levels[userID] = l
+	} else {
+		l.smoothed += speakerSmoothing * (level - l.smoothed)
+	}
+	l.updatedAt = now
+
+	loudest, loudestLevel := d.loudest(now)
+	if loudest == 0 || loudest == d.dominant || loudestLevel < speakerThreshold {
+		return d.dominant, false
+	}
+
+	if d.dominant != 0 {
+		if now.Sub(d.since) < speakerHoldTime || loudestLevel < speakerHysteresis*d.level(d.dominant, now) {
+			return d.dominant, false
+		}
+	}
+
+	d.dominant, d.since = loudest, now
+	return d.dominant, true
+}
+
+// loudest returns the member with the highest smoothed level and that level.
+func (d *speakerDetector) loudest(now time.Time) (uint, float64) {
+	var loudest uint
+	var loudestLevel float64
+	for id := range d.levels {
+		if level := d.level(id, now); level > loudestLevel {
+			loudest, loudestLevel = id, level
+		}
+	}
+
+	return loudest, loudestLevel
+}
+
+// level returns the smoothed level of the member, zero when they haven't reported one lately.
+func (d *speakerDetector) level(userID uint, now time.Time) float64 {
+	l, ok := d.levels[userID]
+	if !ok || now.Sub(l.updatedAt) > speakerLevelTTL {
+		return 0
+	}
+
+	return l.smoothed
+}
+
+// remove forgets the member who left the room. The next speaker takes over without waiting when
+// they were the dominant speaker.
+func (d *speakerDetector) remove(userID uint) {
+	delete(d.levels, userID)
+	if d.dominant == userID {
+		d.dominant = 0
+	}
+}
+
+// addAudioLevel adds the audio level sample of the member to the dominant speaker detection, and
+// tells every member when the dominant speaker changed. The muted members are taken to be silent.
+func (r *Room) addAudioLevel(userID uint, level float64) error {
+	member, ok := r.states[userID]
+	if !ok {
+		return ErrNotRoomMember
+	}
+
+	if member.AudioMuted {
+		level = 0
+	}
+
+	if speaker, changed := r.speakers.add(userID, level, time.Now()); changed {
+		r.broadcast(newResponse(ActiveSpeaker, ActiveSpeakerMessage{RoomID: r.ID, UserID: speaker}), 0)
+	}
+
+	return nil
+}
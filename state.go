@@ -0,0 +1,268 @@
+package talky
+
+import (
+	"sort"
+	"time"
+)
+
+// maxChatHistory is how many of the latest chat messages a room keeps for the members joining late.
+const maxChatHistory = 50
+
+// mediaStateTTL is how long the media state of a member who left is remembered, so they get it back
+// when they join again after losing their connection.
+const mediaStateTTL = 2 * time.Minute
+
+// MediaState tells the other members which of their media a member turned off.
+type MediaState struct {
+	AudioMuted bool `json:"audio_muted"`
+	VideoMuted bool `json:"video_muted"`
+}
+
+// MemberState is what the other members know about a member of a room.
+type MemberState struct {
+	User User `json:"user"`
+	Host bool `json:"host"`
+	MediaState
+	ScreenShare string    `json:"screen_share,omitempty"` // ScreenShare is the id of the stream of the screen the member shares.
+	HandRaised  bool      `json:"hand_raised"`
+	JoinedAt    time.Time `json:"joined_at"`
+}
+
+// RoomSettings are the settings a room was created with.
+type RoomSettings struct {
+	RoomType        RoomType `json:"room_type"`
+	Host            uint     `json:"host"`
+	RelayOnly       bool     `json:"relay_only"`
+	E2EE            bool     `json:"e2ee"`
+	MaxMembers      int      `json:"max_members"`
+	MaxScreenShares int      `json:"max_screen_shares"`
+}
+
+// snapshot returns the state of the room. It is sent to the members joining the room and to those
+// connecting again, the changes after it are sent as they happen.
+func (r *Room) snapshot() RoomStateMessage {
+	state := RoomStateMessage{
+		RoomID: r.ID,
+		Settings: RoomSettings{
+			RoomType:        r.RoomType,
+			Host:            r.Host,
+			RelayOnly:       r.RelayOnly,
+			E2EE:            r.E2EE,
+			MaxMembers:      r.capacity(),
+			MaxScreenShares: r.MaxScreenShares,
+		},
+		Members:  make([]MemberState, 0, len(r.states)),
+		Chat:     append([]ChatMessage{}, r.chat...),
+		KeyEpoch: r.keyEpoch,
+
+		ActiveSpeaker: r.speakers.dominant,
+	}
+
+	for id, member := range r.states {
+		m := *member
+		m.Host = id == r.Host
+		if i := r.screenShareIndex(id); i >= 0 {
+			m.ScreenShare = r.screenShares[i].StreamID
+		}
+		state.Members = append(state.Members, m)
+	}
+
+	sort.Slice(state.Members, func(i, j int) bool {
+		a, b := state.Members[i], state.Members[j]
+		if a.JoinedAt.Equal(b.JoinedAt) {
+			return a.User.ID < b.User.ID
+		}
+		return a.JoinedAt.Before(b.JoinedAt)
+	})
+
+	return state
+}
+
+// sendChat sends the chat message to every member. The end-to-end encrypted rooms don't keep the
+// messages, the members joining late don't get them.
+func (r *Room) sendChat(msg ChatMessage) error {
+	if _, ok := r.Members[msg.User.ID]; !ok {
+		return ErrNotRoomMember
+	}
+
+	msg.SentAt = time.Now()
+	if !r.E2EE {
+		r.chat = append(r.chat, msg)
+		if len(r.chat) > maxChatHistory {
+			r.chat = append([]ChatMessage(nil), r.chat[len(r.chat)-maxChatHistory:]...)
+		}
+	}
+
+	r.broadcast(newResponse(Chat, msg), 0)
+	return nil
+}
+
+// raiseHand raises or lowers the hand of the member and tells every member. The members may only
+// lower the hands of the others when they moderate the room.
+func (r *Room) raiseHand(userID uint, raised bool, by *User) error {
+	if _, ok := r.Members[by.ID]; !ok {
+		return ErrNotRoomMember
+	}
+
+	if userID != by.ID && (raised || !r.canModerate(by)) {
+		return ErrNotHost
+	}
+
+	member, ok := r.states[userID]
+	if !ok {
+		return ErrNotRoomMember
+	}
+
+	if member.HandRaised == raised {
+		return nil
+	}
+
+	member.HandRaised = raised
+	r.broadcast(newResponse(HandRaise, HandRaiseMessage{RoomID: r.ID, UserID: userID, Raised: raised, ChangedBy: by.ID}), 0)
+	return nil
+}
+
+// changeMedia changes the media state of the member and tells every member. The members may only
+// mute the others, and only when they moderate the room.
+func (r *Room) changeMedia(userID uint, audioMuted, videoMuted *bool, by *User) error {
+	if _, ok := r.Members[by.ID]; !ok {
+		return ErrNotRoomMember
+	}
+
+	if userID != by.ID && (isFalse(audioMuted) || isFalse(videoMuted) || !r.canModerate(by)) {
+		return ErrNotHost
+	}
+
+	member, ok := r.states[userID]
+	if !ok {
+		return ErrNotRoomMember
+	}
+
+	media := member.MediaState
+	if audioMuted != nil {
+		media.AudioMuted = *audioMuted
+	}
+	if videoMuted != nil {
+		media.VideoMuted = *videoMuted
+	}
+
+	r.setMedia(member, media, by.ID)
+	return nil
+}
+
+// muteAll mutes the audio, the video or both of every member but the moderator doing it. It
+// returns how many members were muted.
+func (r *Room) muteAll(audio, video bool, by *User) (int, error) {
+	if _, ok := r.Members[by.ID]; !ok {
+		return 0, ErrNotRoomMember
+	}
+
+	if !r.canModerate(by) {
+		return 0, ErrNotHost
+	}
+
+	muted := 0
+	for id, member := range r.states {
+		if id == by.ID {
+			continue
+		}
+
+		media := member.MediaState
+		media.AudioMuted = media.AudioMuted || audio
+		media.VideoMuted = media.VideoMuted || video
+		if r.setMedia(member, media, by.ID) {
+			muted++
+		}
+	}
+
+	return muted, nil
+}
+
+// setMedia changes the media state of the member and tells every member about it, unless nothing
+// changed. It reports if the state was changed.
+func (r *Room) setMedia(member *MemberState, media MediaState, by uint) bool {
+	if member.MediaState == media {
+		return false
+	}
+
+	member.MediaState = media
+	r.broadcast(newResponse(MediaStateChange, MediaStateMessage{
+		RoomID:     r.ID,
+		UserID:     member.User.ID,
+		AudioMuted: &media.AudioMuted,
+		VideoMuted: &media.VideoMuted,
+		ChangedBy:  by,
+	}), 0)
+	return true
+}
+
+// mediaOf returns the media state of the member.
+func (r *Room) mediaOf(userID uint) (MediaState, bool) {
+	member, ok := r.states[userID]
+	if !ok {
+		return MediaState{}, false
+	}
+
+	return member.MediaState, true
+}
+
+// canModerate reports if the user may change the state of the other members, the host and the
+// moderators may.
+func (r *Room) canModerate(user *User) bool {
+	return user.ID == r.Host || user.HasRole(RoleModerator)
+}
+
+func isFalse(b *bool) bool {
+	return b != nil && !*b
+}
+
+type mediaStateKey struct {
+	roomID string
+	userID uint
+}
+
+type savedMediaState struct {
+	media     MediaState
+	expiresAt time.Time
+}
+
+// mediaStateCache remembers the media state of the members who left a room for a while. Only the
+// run loop of the hub uses it.
+type mediaStateCache struct {
+	states map[mediaStateKey]savedMediaState
+	ttl    time.Duration
+}
+
+func newMediaStateCache(ttl time.Duration) *mediaStateCache {
+	return &mediaStateCache{
+		states: make(map[mediaStateKey]savedMediaState),
+		ttl:    ttl,
+	}
+}
+
+// put remembers the media state the member left the room with, it forgets the expired ones.
+func (c *mediaStateCache) put(roomID string, userID uint, media MediaState) {
+	now := time.Now()
+	for key, saved := range c.states {
+		if now.After(saved.expiresAt) {
+			delete(c.states, key)
+		}
+	}
+
+	c.states[mediaStateKey{roomID: roomID, userID: userID}] = savedMediaState{media: media, expiresAt: now.Add(c.ttl)}
+}
+
+// get returns the media state the member left the room with, unless it expired.
+func (c *mediaStateCache) get(roomID string, userID uint) (MediaState, bool) {
+	saved, ok := c.states[mediaStateKey{roomID: roomID, userID: userID}]
+	if !ok || time.Now().After(saved.expiresAt) {
+		return MediaState{}, false
+	}
+
+	return saved.media, true
+}
+
+// forget drops the media state of the member, once they got it back.
+func (c *mediaStateCache) forget(roomID string, userID uint) {
+	delete(c.states, mediaStateKey{roomID: roomID, userID: userID})
+}
@@ -0,0 +1,12 @@
+package store
+
+import "github.com/iamsayantan/talky"
+
+// APIKeyRepository provides the interface for the api key storage.
+type APIKeyRepository interface {
+	CreateAPIKey(key *talky.APIKey) (*talky.APIKey, error)
+	FindByPrefix(prefix string) (*talky.APIKey, error)
+	ListByUser(userID uint) ([]*talky.APIKey, error)
+	Revoke(id uint) error
+	TouchLastUsed(id uint) error
+}
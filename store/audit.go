@@ -0,0 +1,25 @@
+package store
+
+import (
+	"github.com/iamsayantan/talky"
+	"time"
+)
+
+// AuditFilter narrows down the audit events, the zero values match everything.
+type AuditFilter struct {
+	Action       talky.AuditAction
+	ActorID      uint
+	TargetUserID uint
+	RoomID       string
+	Since        time.Time
+	Until        time.Time
+}
+
+// AuditRepository provides the interface for the audit log storage.
+type AuditRepository interface {
+	CreateEvent(event *talky.AuditEvent) error
+
+	// ListEvents returns a page of the matching events, newest first, along with the total number
+	// of matching events.
+	ListEvents(filter AuditFilter, offset, limit int) ([]*talky.AuditEvent, int, error)
+}
@@ -0,0 +1,25 @@
+package store
+
+import (
+	"github.com/iamsayantan/talky"
+	"time"
+)
+
+// CallRepository provides the interface for the call history storage. The calls are returned
+// newest first with their participants.
+type CallRepository interface {
+	CreateCall(call *talky.Call) error
+
+	// FindCall returns the call along with its quality aggregates.
+	FindCall(id uint) (*talky.Call, error)
+
+	// ListUserCalls returns a page of the calls the user took part in, along with their total number.
+	ListUserCalls(userID uint, offset, limit int) ([]*talky.Call, int, error)
+
+	// ListCalls returns the calls started in the given time range, the zero times leave it open.
+	ListCalls(since, until time.Time) ([]*talky.Call, error)
+
+	// ListPoorCalls returns a page of the calls in the time range where a participant had a poor
+	// quality, with their quality aggregates, along with their total number.
+	ListPoorCalls(since, until time.Time, offset, limit int) ([]*talky.Call, int, error)
+}
@@ -0,0 +1,11 @@
+package store
+
+import "github.com/iamsayantan/talky"
+
+// IdentityKeyRepository provides the interface for the storage of the public identity keys. Every
+// user has at most one, saving a new one replaces it.
+type IdentityKeyRepository interface {
+	SaveIdentityKey(key *talky.IdentityKey) (*talky.IdentityKey, error)
+	FindByUser(userID uint) (*talky.IdentityKey, error)
+	DeleteByUser(userID uint) error
+}
@@ -0,0 +1,59 @@
+package mysql
+
+import (
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+type apiKeyRepository struct {
+	db *gorm.DB
+}
+
+func (ar *apiKeyRepository) CreateAPIKey(key *talky.APIKey) (*talky.APIKey, error) {
+	if err := ar.db.Create(key).Error; err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (ar *apiKeyRepository) FindByPrefix(prefix string) (*talky.APIKey, error) {
+	key := &talky.APIKey{}
+	if err := ar.db.Where("prefix = ?", prefix).First(key).Error; err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (ar *apiKeyRepository) ListByUser(userID uint) ([]*talky.APIKey, error) {
+	var keys []*talky.APIKey
+	if err := ar.db.Where("user_id = ?", userID).Order("id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (ar *apiKeyRepository) Revoke(id uint) error {
+	res := ar.db.Model(&talky.APIKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (ar *apiKeyRepository) TouchLastUsed(id uint) error {
+	return ar.db.Model(&talky.APIKey{}).Where("id = ?", id).Update("last_used_at", time.Now()).Error
+}
+
+func NewAPIKeyRepository(db *gorm.DB) store.APIKeyRepository {
+	return &apiKeyRepository{db: db}
+}
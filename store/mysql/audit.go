@@ -0,0 +1,58 @@
+package mysql
+
+import (
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"github.com/jinzhu/gorm"
+)
+
+type auditRepository struct {
+	db *gorm.DB
+}
+
+func (ar *auditRepository) CreateEvent(event *talky.AuditEvent) error {
+	return ar.db.Create(event).Error
+}
+
+func (ar *auditRepository) ListEvents(filter store.AuditFilter, offset, limit int) ([]*talky.AuditEvent, int, error) {
+	query := ar.db.Model(&talky.AuditEvent{})
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+
+	if filter.ActorID != 0 {
+		query = query.Where("actor_id = ?", filter.ActorID)
+	}
+
+	if filter.TargetUserID != 0 {
+		query = query.Where("target_user_id = ?", filter.TargetUserID)
+	}
+
+	if filter.RoomID != "" {
+		query = query.Where("room_id = ?", filter.RoomID)
+	}
+
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var events []*talky.AuditEvent
+	if err := query.Order("id desc").Offset(offset).Limit(limit).Find(&events).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+func NewAuditRepository(db *gorm.DB) store.AuditRepository {
+	return &auditRepository{db: db}
+}
@@ -0,0 +1,84 @@
+package mysql
+
+import (
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+type callRepository struct {
+	db *gorm.DB
+}
+
+func (cr *callRepository) CreateCall(call *talky.Call) error {
+	return cr.db.Create(call).Error
+}
+
+func (cr *callRepository) FindCall(id uint) (*talky.Call, error) {
+	call := &talky.Call{}
+	if err := cr.db.Preload("Participants").Preload("Quality").First(call, id).Error; err != nil {
+		return nil, err
+	}
+
+	return call, nil
+}
+
+func (cr *callRepository) ListUserCalls(userID uint, offset, limit int) ([]*talky.Call, int, error) {
+	participated := cr.db.Model(&talky.CallParticipant{}).Select("call_id").Where("user_id = ?", userID).SubQuery()
+	query := cr.db.Model(&talky.Call{}).Where("id IN ?", participated)
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var calls []*talky.Call
+	if err := query.Preload("Participants").Order("id desc").Offset(offset).Limit(limit).Find(&calls).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return calls, total, nil
+}
+
+func (cr *callRepository) ListCalls(since, until time.Time) ([]*talky.Call, error) {
+	var calls []*talky.Call
+	if err := startedBetween(cr.db, since, until).Preload("Participants").Order("id desc").Find(&calls).Error; err != nil {
+		return nil, err
+	}
+
+	return calls, nil
+}
+
+func (cr *callRepository) ListPoorCalls(since, until time.Time, offset, limit int) ([]*talky.Call, int, error) {
+	query := startedBetween(cr.db.Model(&talky.Call{}), since, until).Where("poor_quality = ?", true)
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var calls []*talky.Call
+	if err := query.Preload("Participants").Preload("Quality").Order("id desc").Offset(offset).Limit(limit).Find(&calls).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return calls, total, nil
+}
+
+// startedBetween limits the query to the calls started in the time range, the zero times leave it open.
+func startedBetween(query *gorm.DB, since, until time.Time) *gorm.DB {
+	if !since.IsZero() {
+		query = query.Where("started_at >= ?", since)
+	}
+
+	if !until.IsZero() {
+		query = query.Where("started_at < ?", until)
+	}
+
+	return query
+}
+
+func NewCallRepository(db *gorm.DB) store.CallRepository {
+	return &callRepository{db: db}
+}
@@ -0,0 +1,49 @@
+package mysql
+
+import (
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"github.com/jinzhu/gorm"
+)
+
+type identityKeyRepository struct {
+	db *gorm.DB
+}
+
+func (ir *identityKeyRepository) SaveIdentityKey(key *talky.IdentityKey) (*talky.IdentityKey, error) {
+	saved := &talky.IdentityKey{}
+	err := ir.db.Where(talky.IdentityKey{UserID: key.UserID}).
+		Assign(talky.IdentityKey{Algorithm: key.Algorithm, PublicKey: key.PublicKey, Fingerprint: key.Fingerprint}).
+		FirstOrCreate(saved).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+func (ir *identityKeyRepository) FindByUser(userID uint) (*talky.IdentityKey, error) {
+	key := &talky.IdentityKey{}
+	if err := ir.db.Where("user_id = ?", userID).First(key).Error; err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (ir *identityKeyRepository) DeleteByUser(userID uint) error {
+	res := ir.db.Where("user_id = ?", userID).Delete(&talky.IdentityKey{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func NewIdentityKeyRepository(db *gorm.DB) store.IdentityKeyRepository {
+	return &identityKeyRepository{db: db}
+}
@@ -0,0 +1,60 @@
+package mysql
+
+import (
+	"github.com/iamsayantan/talky"
+	"github.com/iamsayantan/talky/store"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+type tokenRepository struct {
+	db *gorm.DB
+}
+
+func (tr *tokenRepository) CreateToken(token *talky.UserToken) (*talky.UserToken, error) {
+	if err := tr.db.Create(token).Error; err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (tr *tokenRepository) ConsumeToken(hash string, purpose talky.TokenPurpose) (*talky.UserToken, error) {
+	token := &talky.UserToken{}
+	err := tr.db.Where("token_hash = ? AND purpose = ?", hash, purpose).First(token).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, talky.ErrInvalidToken
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.IsUsable() {
+		return nil, talky.ErrInvalidToken
+	}
+
+	// the used_at condition makes sure only one of two concurrent requests can use the token.
+	now := time.Now()
+	res := tr.db.Model(&talky.UserToken{}).
+		Where("id = ? AND used_at IS NULL", token.ID).
+		Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, talky.ErrInvalidToken
+	}
+
+	token.UsedAt = &now
+	return token, nil
+}
+
+func (tr *tokenRepository) DeleteUserTokens(userID uint, purpose talky.TokenPurpose) error {
+	return tr.db.Where("user_id = ? AND purpose = ?", userID, purpose).Delete(&talky.UserToken{}).Error
+}
+
+func NewTokenRepository(db *gorm.DB) store.TokenRepository {
+	return &tokenRepository{db: db}
+}
@@ -46,6 +46,74 @@ func (ur *userRepository) FindByUsername(username string) (*talky.User, error) {
 	return user, nil
 }
 
+func (ur *userRepository) FindByEmail(email string) (*talky.User, error) {
+	user := &talky.User{}
+	if err := ur.db.Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (ur *userRepository) MarkEmailVerified(id uint) error {
+	return ur.db.Model(&talky.User{}).Where("id = ?", id).Update("email_verified", true).Error
+}
+
+func (ur *userRepository) UpdatePassword(id uint, passwordHash string) error {
+	return ur.db.Model(&talky.User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"password":      passwordHash,
+		"token_version": gorm.Expr("token_version + 1"),
+	}).Error
+}
+
+func (ur *userRepository) UpdateName(id uint, firstName, lastName string) error {
+	return ur.db.Model(&talky.User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"first_name": firstName,
+		"last_name":  lastName,
+	}).Error
+}
+
+func (ur *userRepository) UpdateEmail(id uint, email string) error {
+	return ur.db.Model(&talky.User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"email":          email,
+		"email_verified": false,
+	}).Error
+}
+
+func (ur *userRepository) UpdateAvatar(id uint, avatarURL string) error {
+	return ur.db.Model(&talky.User{}).Where("id = ?", id).Update("avatar_url", avatarURL).Error
+}
+
+func (ur *userRepository) SetDisabled(id uint, disabled bool) error {
+	return ur.db.Model(&talky.User{}).Where("id = ?", id).Update("disabled", disabled).Error
+}
+
+func (ur *userRepository) UpdateRole(id uint, role talky.Role) error {
+	return ur.db.Model(&talky.User{}).Where("id = ?", id).Update("role", role).Error
+}
+
+func (ur *userRepository) ListUsers(offset, limit int) ([]*talky.User, int, error) {
+	var total int
+	if err := ur.db.Model(&talky.User{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var users []*talky.User
+	if err := ur.db.Order("id").Offset(offset).Limit(limit).Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+func (ur *userRepository) DeleteUser(id uint) error {
+	if id == 0 {
+		return ErrInvalidUserDetails
+	}
+
+	return ur.db.Where("id = ?", id).Delete(&talky.User{}).Error
+}
+
 func NewUserRepository(db *gorm.DB) store.UserRepository {
 	return &userRepository{db: db}
 }
@@ -0,0 +1,15 @@
+package store
+
+import "github.com/iamsayantan/talky"
+
+// TokenRepository provides the interface for the storage of the single use user tokens.
+type TokenRepository interface {
+	CreateToken(token *talky.UserToken) (*talky.UserToken, error)
+
+	// ConsumeToken marks the token with the hash as used and returns it. It returns talky.ErrInvalidToken
+	// if the token does not exist, has a different purpose, is expired or was already used.
+	ConsumeToken(hash string, purpose talky.TokenPurpose) (*talky.UserToken, error)
+
+	// DeleteUserTokens removes all the tokens of the user with the given purpose.
+	DeleteUserTokens(userID uint, purpose talky.TokenPurpose) error
+}
@@ -7,4 +7,30 @@ type UserRepository interface {
 	CreateUser(user *talky.User) (*talky.User, error)
 	FindById(id uint) (*talky.User, error)
 	FindByUsername(username string) (*talky.User, error)
+	FindByEmail(email string) (*talky.User, error)
+	MarkEmailVerified(id uint) error
+	// UpdatePassword changes the password of the user and invalidates their access tokens.
+	UpdatePassword(id uint, passwordHash string) error
+
+	// UpdateName only changes the name of the user. The updates below only write their own columns
+	// too, so they don't undo the changes made since the user was loaded.
+	UpdateName(id uint, firstName, lastName string) error
+
+	// UpdateEmail changes the email of the user, which has to be verified again.
+	UpdateEmail(id uint, email string) error
+
+	// UpdateAvatar changes the path of the avatar of the user, an empty path removes it.
+	UpdateAvatar(id uint, avatarURL string) error
+
+	// SetDisabled disables or enables the user.
+	SetDisabled(id uint, disabled bool) error
+
+	// UpdateRole changes the role of the user.
+	UpdateRole(id uint, role talky.Role) error
+
+	// ListUsers returns a page of users ordered by id, along with the total number of users.
+	ListUsers(offset, limit int) ([]*talky.User, int, error)
+
+	// DeleteUser soft deletes the user, after which they can't be found anymore.
+	DeleteUser(id uint) error
 }
@@ -0,0 +1,74 @@
+package talky
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+)
+
+type TokenPurpose string
+
+const (
+	TokenEmailVerification TokenPurpose = "email_verification"
+	TokenPasswordReset     TokenPurpose = "password_reset"
+)
+
+// UserToken is a single use token sent to the user by email, for example to verify their email
+// address or to reset their password. Only the hash of the token is stored, the token itself
+// only ever exists in the email.
+type UserToken struct {
+	ID        uint         `gorm:"primary_key"`
+	UserID    uint         `gorm:"index"`
+	Purpose   TokenPurpose `gorm:"type:varchar(32)"`
+	TokenHash string       `gorm:"type:varchar(64);unique_index"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// NewUserToken generates a new random token for the user. It returns the token to be stored and
+// the plain text token which should be sent to the user.
+func NewUserToken(userID uint, purpose TokenPurpose, ttl time.Duration) (*UserToken, string, error) {
+	plain, err := RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := &UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: HashToken(plain),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	return token, plain, nil
+}
+
+// IsUsable reports if the token can still be used.
+func (t *UserToken) IsUsable() bool {
+	return t.UsedAt == nil && time.Now().Before(t.ExpiresAt)
+}
+
+// RandomToken returns n random bytes encoded as an url safe string.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded sha256 hash of the token. The tokens are long random strings,
+// so a fast hash is enough here unlike passwords.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
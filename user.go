@@ -2,20 +2,87 @@ package talky
 
 import (
 	"errors"
+	"net/mail"
 	"time"
 )
 
+// User is a registered user. The json representation is public and is shared with the other
+// members of a room, so private fields like the email are not part of it.
 type User struct {
-	ID        uint       `gorm:"primary_key" json:"id"`
-	Username  string     `json:"username"`
-	FirstName string     `json:"first_name"`
-	LastName  string     `json:"last_name"`
-	Password  string     `json:"-"`
+	ID        uint   `gorm:"primary_key" json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	AvatarURL string `json:"avatar_url,omitempty"` // AvatarURL is the path of the avatar, a size query parameter picks the thumbnail.
+	Email     string `gorm:"index" json:"-"`
+	Password  string `json:"-"`
+	Role      Role   `gorm:"type:varchar(16);default:'user'" json:"role"`
+	Bot       bool   `json:"bot"` // Bot accounts are used by programs, they authenticate with api keys.
+
+	// Disabled users can't login or connect anymore, only an admin can enable them again.
+	Disabled bool `json:"-"`
+
+	// EmailVerified is set once the user opened the verification link sent to their email.
+	EmailVerified bool `json:"-"`
+
+	// TokenVersion is raised when the password changes, the access tokens issued for an older
+	// version are not accepted anymore.
+	TokenVersion uint `gorm:"not null;default:0" json:"-"`
+
+	// Guest users are not stored, they join a single room through an invitation link.
+	Guest       bool   `gorm:"-" json:"guest,omitempty"`
+	GuestRoomID string `gorm:"-" json:"-"`
+
+	// Scopes limit what the user can do with the credentials they authenticated with. It is nil
+	// when they are not limited, which is the case unless an api key was used.
+	Scopes []string `gorm:"-" json:"-"`
+
+	// IdentityKey is the fingerprint of the identity key the user had when they connected, the end-to-end
+	// encrypted rooms can only be joined with one.
+	IdentityKey string `gorm:"-" json:"-"`
+
 	CreatedAt time.Time  `json:"-"`
 	UpdatedAt time.Time  `json:"-"`
 	DeletedAt *time.Time `sql:"index" json:"-"`
 }
 
+// HasRole reports if the user has at least the permissions of the role. Users created before
+// roles existed have an empty role and are treated as normal users.
+func (u *User) HasRole(role Role) bool {
+	if u.Role == "" {
+		return RoleUser.Includes(role)
+	}
+
+	return u.Role.Includes(role)
+}
+
+// IsRecorder reports if the user records the calls. Only the bots whose api key was given the
+// record scope do, HasScope would report it for everyone who isn't limited by scopes.
+func (u *User) IsRecorder() bool {
+	for _, s := range u.Scopes {
+		if s == ScopeRecord {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope reports if the credentials the user authenticated with allow the scope.
+func (u *User) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (u *User) IsValid() error {
 	var err error
 
@@ -34,6 +101,16 @@ func (u *User) IsValid() error {
 		return err
 	}
 
+	if u.Email == "" {
+		err = errors.New("email can not be left blank")
+		return err
+	}
+
+	if _, err = mail.ParseAddress(u.Email); err != nil {
+		err = errors.New("email is not valid")
+		return err
+	}
+
 	if u.Password == "" {
 		err = errors.New("password can not be left blank")
 		return err